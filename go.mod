@@ -2,4 +2,4 @@ module network-golang
 
 go 1.22.0
 
-require golang.org/x/sys v0.22.0 // indirect
+require golang.org/x/sys v0.22.0
@@ -1,24 +1,169 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log"
+	"net"
+	"net/http"
 	"network-golang/tftp"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	address = flag.String("a", "127.0.0.1:69", "listen address")
-	payload = flag.String("p", "payload.svg", "file to serve to clients")
+	address  = flag.String("a", "127.0.0.1:69", "listen address")
+	payload  = flag.String("p", "payload.svg", "file to serve to clients")
+	root     = flag.String("d", "", "directory or .zip, .tar, .tar.gz archive to serve files from instead of the payload, archives are reloaded on SIGHUP")
+	upload   = flag.String("u", "", "directory to store uploads in, uploads are disabled when empty")
+	maxSize  = flag.Int64("max-upload", 0, "largest upload accepted in bytes, zero means no limit")
+	quota    = flag.Int64("quota", 0, "bytes the upload directory may hold, zero means no limit")
+	perQuota = flag.Int64("client-quota", 0, "bytes one client may upload, zero means no limit")
+	replace  = flag.Bool("overwrite", false, "let completed uploads replace existing files")
+	rollover = flag.Uint("rollover", 0, "block number following 65535, 0 or 1")
+	remap    = flag.String("m", "", "file of rules remapping requested filenames")
+	rate     = flag.Int64("rate", 0, "bytes per second of all transfers together, zero means no limit")
+	perIP    = flag.Int64("client-rate", 0, "bytes per second of the transfers of one client, zero means no limit")
+	maxConns = flag.Int("max-transfers", 0, "transfers in flight at once, zero means no limit")
+	queue    = flag.Duration("queue", 0, "how long requests over -max-transfers wait before they are refused")
+	origin   = flag.String("origin", "", "tftp:// or http(s):// URL of an upstream server to relay requests to instead of serving local files")
+	cacheDir = flag.String("cache", "cache", "directory the files relayed from -origin are cached in")
+	ttl      = flag.Duration("ttl", 5*time.Minute, "how long a relayed file is served from the cache before it is revalidated")
+	admin    = flag.String("admin", "", "address or unix socket path of the admin API listing and canceling transfers")
 )
 
 func main() {
+	// allow and deny rules are checked in the order they are given
+	var access []tftp.AccessRule
+	accessFlag := func(verb string) func(string) error {
+		return func(value string) error {
+			rule, err := tftp.ParseAccessRule(verb + " " + value)
+			access = append(access, rule)
+			return err
+		}
+	}
+	flag.Func("allow", "allow clients in `cidr` followed by an optional filename prefix, repeatable, clients matching no rule are then denied", accessFlag("allow"))
+	flag.Func("deny", "deny clients in `cidr` followed by an optional filename prefix, repeatable", accessFlag("deny"))
 	flag.Parse()
-	p, err := os.ReadFile(*payload)
-	if err != nil {
+	// log.Fatal skips deferred calls, the gunzipped copy of an archive
+	// must not be left behind
+	var archive *tftp.Archive
+	fatal := func(err error) {
+		if archive != nil {
+			_ = archive.Close()
+		}
 		log.Fatal(err)
 	}
-	s := tftp.Server{Payload: p}
-	log.Fatal(s.ListenAndServe(*address))
-
+	s := tftp.Server{
+		UploadDir:       *upload,
+		MaxUploadSize:   *maxSize,
+		UploadQuota:     *quota,
+		ClientQuota:     *perQuota,
+		Overwrite:       *replace,
+		Rollover:        uint16(*rollover),
+		Access:          access,
+		RateLimit:       *rate,
+		ClientRateLimit: *perIP,
+		MaxTransfers:    *maxConns,
+		QueueTimeout:    *queue,
+	}
+	if *remap != "" {
+		m, err := tftp.LoadRemap(*remap)
+		if err != nil {
+			fatal(err)
+		}
+		s.Remap = m
+	}
+	if *origin != "" {
+		s.Handler = &tftp.Relay{Origin: *origin, CacheDir: *cacheDir, TTL: *ttl}
+	} else if info, err := os.Stat(*root); err == nil && !info.IsDir() {
+		archive, err = tftp.OpenArchive(*root)
+		if err != nil {
+			fatal(err)
+		}
+		defer func() { _ = archive.Close() }()
+		s.FS = archive
+		// switch to a new version of the archive on hangup
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := archive.Load(*root); err != nil {
+					log.Printf("reloading %s: %v", *root, err)
+					continue
+				}
+				log.Printf("reloaded %s", *root)
+			}
+		}()
+	} else if *root != "" {
+		s.FS = os.DirFS(*root)
+	} else {
+		// the payload is streamed from disk, transfers share the open file
+		f, err := os.Open(*payload)
+		if err != nil {
+			fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		info, err := f.Stat()
+		if err != nil {
+			fatal(err)
+		}
+		s.Handler = tftp.ReaderAtServer(f, info.Size())
+	}
+	var api *http.Server
+	if *admin != "" {
+		// a path is a unix socket, which keeps the API off the network
+		network := "tcp"
+		if strings.ContainsRune(*admin, os.PathSeparator) {
+			network = "unix"
+			// a socket left behind by an earlier run is replaced, any
+			// other file is not ours to remove
+			if info, err := os.Lstat(*admin); err == nil {
+				if info.Mode().Type() != fs.ModeSocket {
+					fatal(fmt.Errorf("admin: %s exists and is not a socket", *admin))
+				}
+				if err = os.Remove(*admin); err != nil {
+					fatal(err)
+				}
+			}
+		}
+		l, err := net.Listen(network, *admin)
+		if err != nil {
+			fatal(err)
+		}
+		api = &http.Server{Handler: s.AdminHandler()}
+		go func() {
+			if err := api.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("admin: %v", err)
+			}
+		}()
+	}
+	// stop serving on interrupt and give transfers in flight time to finish
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-c
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		if api != nil {
+			_ = api.Shutdown(ctx)
+		}
+	}()
+	err := s.ListenAndServe(*address)
+	if !errors.Is(err, tftp.ErrServerClosed) {
+		fatal(err)
+	}
+	// Serve returns right away, wait for the transfers to finish
+	<-done
 }
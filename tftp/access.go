@@ -0,0 +1,114 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ErrAccessDenied is the error of transfers refused by the access rules
+var ErrAccessDenied = errors.New("tftp: access denied")
+
+// AccessRule allows or denies the clients in Network to transfer files.
+// The rules of a server are checked in order and the first rule matching
+// the client and filename decides. Clients matching no rule are denied
+// once any rule allows, with deny rules alone they are allowed
+type AccessRule struct {
+	Deny    bool
+	Network netip.Prefix
+	Prefix  string // filename prefix the rule is limited to, empty for every file
+}
+
+// ParseAccessRule parses a rule written as "allow" or "deny" followed by
+// a CIDR network or a single address and an optional filename prefix,
+// for example "deny 10.0.0.0/8 private/"
+func ParseAccessRule(s string) (AccessRule, error) {
+	var rule AccessRule
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, fmt.Errorf("tftp: invalid access rule %q", s)
+	}
+	switch fields[0] {
+	case "allow":
+	case "deny":
+		rule.Deny = true
+	default:
+		return rule, fmt.Errorf("tftp: invalid access rule %q: expected allow or deny", s)
+	}
+	network, err := netip.ParsePrefix(fields[1])
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(fields[1])
+		if addrErr != nil {
+			return rule, fmt.Errorf("tftp: invalid access rule %q: %w", s, err)
+		}
+		network = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	rule.Network = network.Masked()
+	if len(fields) == 3 {
+		rule.Prefix = fields[2]
+	}
+	return rule, nil
+}
+
+// String formats the rule the way ParseAccessRule reads it
+func (r AccessRule) String() string {
+	s := "allow " + r.Network.String()
+	if r.Deny {
+		s = "deny " + r.Network.String()
+	}
+	if r.Prefix != "" {
+		s += " " + r.Prefix
+	}
+	return s
+}
+
+// matches reports whether the rule applies to the client asking for filename
+func (r AccessRule) matches(client netip.Addr, filename string) bool {
+	return r.Network.Contains(client) && strings.HasPrefix(filename, r.Prefix)
+}
+
+// allowed reports whether the access rules let the client at addr transfer filename
+func (s *Server) allowed(addr net.Addr, filename string) bool {
+	if len(s.Access) == 0 {
+		return true
+	}
+	client, ok := clientIP(addr)
+	if !ok {
+		return false
+	}
+	for _, rule := range s.Access {
+		if rule.matches(client, filename) {
+			return !rule.Deny
+		}
+	}
+	// an allow list lets in the clients it names and nobody else
+	for _, rule := range s.Access {
+		if !rule.Deny {
+			return false
+		}
+	}
+	return true
+}
+
+// authorize remaps the filename a client at addr asked for and checks the
+// result against the access rules. It returns the filename to transfer.
+// A denied request is answered with an error from conn before it takes a
+// transfer slot, a socket or shows up in the hooks, authorize reports false
+func (s *Server) authorize(conn net.PacketConn, addr net.Addr, filename string, op OpCode) (string, bool) {
+	name, err := s.remap(filename, addr, op)
+	if err == nil && name != filename {
+		log.Printf("[%s] remapped %s to %s", addr, filename, name)
+	}
+	if err == nil && !s.allowed(addr, name) {
+		err = ErrAccessDenied
+	}
+	if err != nil {
+		log.Printf("[%s] denied %s: %v", addr, filename, err)
+		replyErr(conn, addr, ErrAccessViolation, "access violation")
+		return name, false
+	}
+	return name, true
+}
@@ -0,0 +1,123 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAccessRules(t *testing.T) {
+	var rules []AccessRule
+	for _, s := range []string{
+		"allow 192.0.2.10 private/",
+		"deny 192.0.2.0/24 private/",
+		"deny 198.51.100.0/24",
+		"allow 2001:db8::/32",
+	} {
+		rule, err := ParseAccessRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	s := &Server{Access: rules}
+
+	tests := []struct {
+		ip       string
+		filename string
+		expected bool
+	}{
+		{"192.0.2.10", "private/key", true},
+		{"192.0.2.11", "private/key", false},
+		{"192.0.2.11", "pxelinux.0", false},
+		{"::ffff:192.0.2.11", "private/key", false},
+		{"198.51.100.1", "pxelinux.0", false},
+		{"2001:db8::1", "private/key", true},
+		// the allow rules leave out everyone else
+		{"203.0.113.1", "private/key", false},
+	}
+	for _, test := range tests {
+		addr := &net.UDPAddr{IP: net.ParseIP(test.ip), Port: 1024}
+		if actual := s.allowed(addr, test.filename); actual != test.expected {
+			t.Errorf("%s %s: expected allowed %t; actual %t", test.ip, test.filename, test.expected, actual)
+		}
+	}
+
+	// without allow rules only the denied clients are left out
+	s.Access = rules[1:3]
+	for ip, expected := range map[string]bool{"192.0.2.11": true, "198.51.100.1": false, "203.0.113.1": true} {
+		addr := &net.UDPAddr{IP: net.ParseIP(ip), Port: 1024}
+		if actual := s.allowed(addr, "pxelinux.0"); actual != expected {
+			t.Errorf("%s with deny rules only: expected allowed %t; actual %t", ip, expected, actual)
+		}
+	}
+
+	for _, invalid := range []string{"allow", "permit 10.0.0.0/8", "deny 10.0.0.0/33", "deny host"} {
+		if _, err := ParseAccessRule(invalid); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestServerAccess(t *testing.T) {
+	deny, err := ParseAccessRule("deny 127.0.0.0/8 secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan TransferStats, 3)
+	var started atomic.Int32
+	addr := serve(t, &Server{
+		Payload:         []byte("payload"),
+		UploadDir:       t.TempDir(),
+		Access:          []AccessRule{deny},
+		MaxTransfers:    1,
+		OnTransferStart: func(TransferStats) { started.Add(1) },
+		OnTransferEnd:   func(stats TransferStats) { ended <- stats },
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+	_, err = c.Get(ctx, addr, "public", new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+
+	// denied requests are refused before they take the only transfer slot
+	ack := holdTransfer(t, addr, "payload")
+	defer ack()
+	var remote *RemoteError
+	_, err = c.Get(ctx, addr, "secret", new(bytes.Buffer))
+	if !errors.As(err, &remote) || remote.Code != ErrAccessViolation {
+		t.Errorf("expected an access violation; actual %v", err)
+	}
+	_, err = c.Put(ctx, addr, "secret", bytes.NewReader([]byte("x")))
+	if !errors.As(err, &remote) || remote.Code != ErrAccessViolation {
+		t.Errorf("expected an access violation uploading; actual %v", err)
+	}
+	// and never reach the hooks
+	if n := started.Load(); n != 2 {
+		t.Errorf("expected 2 transfers to start; actual %d", n)
+	}
+}
+
+func TestServerAllowList(t *testing.T) {
+	allow, err := ParseAccessRule("allow 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, &Server{Payload: []byte("payload"), Access: []AccessRule{allow}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+	var remote *RemoteError
+	_, err = c.Get(ctx, addr, "payload", new(bytes.Buffer))
+	if !errors.As(err, &remote) || remote.Code != ErrAccessViolation {
+		t.Errorf("expected 127.0.0.1 to be left out by the allow list; actual %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package tftp
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Archive is a file system over the members of a .zip, .tar, .tar.gz or
+// .tgz archive. Load switches to another archive while the transfers
+// reading the old one finish, the old archive is closed after them.
+// The zero Archive has no members until an archive is loaded
+type Archive struct {
+	mu     sync.Mutex
+	cur    *archiveGen
+	loads  uint64 // archives loaded so far
+	closed bool
+}
+
+// errNoArchive fails the use of an Archive before anything was loaded
+var errNoArchive = errors.New("tftp: no archive loaded")
+
+// archiveGen is one loaded archive
+type archiveGen struct {
+	id    uint64 // tells the archives loaded over time apart
+	fsys  fs.FS
+	close func() error
+	refs  int // open files, plus one while it is the current archive
+}
+
+// OpenArchive opens the archive name, the format follows its extension
+func OpenArchive(name string) (*Archive, error) {
+	a := new(Archive)
+	if err := a.Load(name); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Load switches to the archive name. The files opened before keep
+// reading the previous archive
+func (a *Archive) Load(name string) error {
+	g, err := openArchive(name)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		_ = g.close()
+		return fs.ErrClosed
+	}
+	a.loads++
+	g.id = a.loads
+	old := a.cur
+	a.cur = g
+	if old != nil {
+		a.release(old)
+	}
+	return nil
+}
+
+// Close closes the archive once the files opened from it are closed
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return fs.ErrClosed
+	}
+	a.closed = true
+	if a.cur != nil {
+		a.release(a.cur)
+	}
+	return nil
+}
+
+func (a *Archive) Open(name string) (fs.File, error) {
+	g, err := a.acquire()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f, err := g.fsys.Open(name)
+	if err != nil {
+		a.done(g)
+		return nil, err
+	}
+	file := &archiveFile{File: f, archive: a, gen: g}
+	switch f.(type) {
+	case io.ReaderAt:
+		return &archiveFileAt{file}, nil
+	case fs.ReadDirFile:
+		return &archiveDir{file}, nil
+	}
+	return file, nil
+}
+
+func (a *Archive) Stat(name string) (fs.FileInfo, error) {
+	g, err := a.acquire()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer a.done(g)
+	return fs.Stat(g.fsys, name)
+}
+
+// version tells the archives loaded over time apart, so the transfers
+// sharing open files switch to the new archive after a Load
+func (a *Archive) version() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.loads
+}
+
+// acquire returns the current archive, it stays open until done is called
+func (a *Archive) acquire() (*archiveGen, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, fs.ErrClosed
+	}
+	if a.cur == nil {
+		return nil, errNoArchive
+	}
+	a.cur.refs++
+	return a.cur, nil
+}
+
+func (a *Archive) done(g *archiveGen) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.release(g)
+}
+
+// release drops a reference to g and closes it after the last one,
+// a.mu must be held
+func (a *Archive) release(g *archiveGen) {
+	if g.refs--; g.refs == 0 {
+		_ = g.close()
+	}
+}
+
+// archiveFile is a file opened from an archive, closing it releases the archive
+type archiveFile struct {
+	fs.File
+	archive *Archive
+	gen     *archiveGen
+	once    sync.Once
+}
+
+func (f *archiveFile) Close() error {
+	err := fs.ErrClosed
+	f.once.Do(func() {
+		err = f.File.Close()
+		f.archive.done(f.gen)
+	})
+	return err
+}
+
+func (f *archiveFile) version() uint64 {
+	return f.gen.id
+}
+
+// archiveFileAt is an archiveFile the transfers can share
+type archiveFileAt struct {
+	*archiveFile
+}
+
+func (f *archiveFileAt) ReadAt(p []byte, off int64) (int, error) {
+	return f.File.(io.ReaderAt).ReadAt(p, off)
+}
+
+// archiveDir is a directory opened from an archive
+type archiveDir struct {
+	*archiveFile
+}
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	return d.File.(fs.ReadDirFile).ReadDir(n)
+}
+
+// openArchive opens the archive name by its extension
+func openArchive(name string) (*archiveGen, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		z, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		return &archiveGen{fsys: z, close: z.Close, refs: 1}, nil
+	case strings.HasSuffix(lower, ".tar"):
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return openTar(f, f.Close)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		f, err := gunzip(name)
+		if err != nil {
+			return nil, err
+		}
+		return openTar(f, func() error {
+			err := f.Close()
+			_ = os.Remove(f.Name())
+			return err
+		})
+	}
+	return nil, fmt.Errorf("tftp: %s is not a .zip, .tar, .tar.gz or .tgz archive", name)
+}
+
+// openTar indexes the tar archive f, closer is called when it is no longer used
+func openTar(f *os.File, closer func() error) (*archiveGen, error) {
+	info, err := f.Stat()
+	if err == nil {
+		var t *tarFS
+		t, err = newTarFS(f, info.Size())
+		if err == nil {
+			return &archiveGen{fsys: t, close: closer, refs: 1}, nil
+		}
+	}
+	_ = closer()
+	return nil, err
+}
+
+// gunzip decompresses the archive name into a temporary file, members of
+// a compressed archive cannot be read without going through the ones before
+func gunzip(name string) (*os.File, error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = src.Close() }()
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := os.CreateTemp("", "tftp-archive-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(dst, zr)
+	if err == nil {
+		err = zr.Close()
+	}
+	if err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dst.Name())
+		return nil, fmt.Errorf("tftp: decompressing %s: %w", name, err)
+	}
+	return dst, nil
+}
@@ -0,0 +1,187 @@
+package tftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// archiveTime is the modification time of every member written by writeArchive
+var archiveTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeArchive writes an archive of files in the format of its extension
+func writeArchive(t *testing.T, name string, files map[string]string) {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if strings.HasSuffix(name, ".zip") {
+		zw := zip.NewWriter(buf)
+		for member, data := range files {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: member, Method: zip.Deflate, Modified: archiveTime})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.WriteString(w, data)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		tw := tar.NewWriter(buf)
+		// a directory header of its own next to one made up for a member
+		_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "pxelinux.cfg/", Mode: 0o755, ModTime: archiveTime})
+		for member, data := range files {
+			err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: member, Mode: 0o644, Size: int64(len(data)), ModTime: archiveTime})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.WriteString(tw, data)
+		}
+		_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "pxelinux.0"})
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+			gz := new(bytes.Buffer)
+			zw := gzip.NewWriter(gz)
+			_, _ = zw.Write(buf.Bytes())
+			_ = zw.Close()
+			buf = gz
+		}
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	files := map[string]string{
+		"pxelinux.0":               strings.Repeat("loader", 200),
+		"pxelinux.cfg/default":     "default menu",
+		"efi/x86_64/grub/grub.cfg": "set timeout=5",
+	}
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		t.Run(ext, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "boot"+ext)
+			writeArchive(t, name, files)
+			a, err := OpenArchive(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = a.Close() }()
+			if err = fstest.TestFS(a, "pxelinux.0", "pxelinux.cfg/default", "efi/x86_64/grub/grub.cfg"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = a.Open("link"); ext != ".zip" && err == nil {
+				t.Error("expected symbolic links to be left out")
+			}
+		})
+	}
+	if _, err := OpenArchive(filepath.Join(t.TempDir(), "boot.rar")); err == nil {
+		t.Error("expected an error opening an unknown format")
+	}
+}
+
+func TestArchiveLoad(t *testing.T) {
+	dir := t.TempDir()
+	v1, v2 := filepath.Join(dir, "v1.tar.gz"), filepath.Join(dir, "v2.zip")
+	writeArchive(t, v1, map[string]string{"pxelinux.0": "version 1"})
+	writeArchive(t, v2, map[string]string{"pxelinux.0": "version 2"})
+	a, err := OpenArchive(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	addr := serve(t, &Server{FS: a})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+	get := func(expected string) {
+		t.Helper()
+		buf := new(bytes.Buffer)
+		if _, err := c.Get(ctx, addr, "pxelinux.0", buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected {
+			t.Errorf("received %q; expected %q", buf.String(), expected)
+		}
+	}
+	get("version 1")
+
+	// a file opened before the switch keeps reading the old archive
+	gen := a.cur
+	old, err := a.Open("pxelinux.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Load(v2); err != nil {
+		t.Fatal(err)
+	}
+	get("version 2")
+	b, err := io.ReadAll(old)
+	if err != nil || string(b) != "version 1" {
+		t.Errorf("read %q from the old archive; expected %q, %v", b, "version 1", err)
+	}
+	if err = old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the old archive is closed with its last file
+	a.mu.Lock()
+	refs := gen.refs
+	a.mu.Unlock()
+	if refs != 0 {
+		t.Errorf("old archive still has %d references", refs)
+	}
+}
+
+func TestArchiveLoadWhileServing(t *testing.T) {
+	dir := t.TempDir()
+	// both versions of the member have the same modification time
+	v1, v2 := filepath.Join(dir, "v1.tar"), filepath.Join(dir, "v2.tgz")
+	writeArchive(t, v1, map[string]string{"pxelinux.0": strings.Repeat("version 1\n", 500)})
+	writeArchive(t, v2, map[string]string{"pxelinux.0": strings.Repeat("version 2\n", 500)})
+	a, err := OpenArchive(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	addr := serve(t, &Server{FS: a})
+
+	// a download of the old member is in flight while the new archive is loaded
+	holdTransfer(t, addr, "pxelinux.0")
+	if err = a.Load(v2); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+	buf := new(bytes.Buffer)
+	if _, err = c.Get(ctx, addr, "pxelinux.0", buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Repeat("version 2\n", 500); buf.String() != expected {
+		t.Errorf("received %q; expected the new archive", buf.String()[:10])
+	}
+}
+
+func TestArchiveZero(t *testing.T) {
+	var a Archive
+	if _, err := a.Open("pxelinux.0"); err == nil {
+		t.Error("expected an error opening a member before an archive was loaded")
+	}
+	if _, err := fs.Stat(&a, "pxelinux.0"); err == nil {
+		t.Error("expected an error stating a member before an archive was loaded")
+	}
+	if err := a.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,574 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client reads and writes files on a TFTP server.
+// The zero value transfers octet files with the RFC 1350 defaults
+type Client struct {
+	BlockSize  int           // blksize to negotiate, zero uses the default block size
+	WindowSize uint16        // windowsize to negotiate, zero or one waits for an ACK after every block
+	Mode       string        // transfer mode, octet when empty
+	Retries    uint8         // number of retries on lost packets
+	Timeout    time.Duration // waiting duration of a reply, also sent as the timeout option
+	Rollover   uint16        // block number following 65535, either 0 or 1
+}
+
+// RemoteError is the error packet the other end of a transfer aborted it with
+type RemoteError struct {
+	Code    ErrCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("tftp: remote error %d: %s", e.Code, e.Message)
+}
+
+// Get reads filename from the server at addr and writes it to w.
+// It returns the number of bytes written to w
+func (c *Client) Get(ctx context.Context, addr, filename string, w io.Writer) (int64, error) {
+	if c.Rollover > 1 {
+		return 0, errors.New("tftp: rollover must be 0 or 1")
+	}
+	mode := c.mode()
+	req, err := ReadReq{Filename: filename, Mode: mode, Options: c.options(-1)}.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	t, err := c.dial(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer t.close()
+
+	cw := &countWriter{w: w}
+	w = cw
+	var dec io.WriteCloser
+	if strings.EqualFold(mode, ModeNetASCII) {
+		dec = NewNetASCIIWriter(cw)
+		w = dec
+	}
+
+	var (
+		opts     = c.defaults()
+		pkt      = req // the packet we resend when the server goes quiet
+		ack      = make([]byte, 0, 4)
+		block    uint16
+		blocks   int  // number of blocks received
+		received int  // blocks received since the last ACK
+		nacked   bool // a block out of order was already answered
+		started  bool // the server answered the request
+		errPkt   ErrReq
+		oack     OAck
+		retries  = c.retries()
+	)
+	err = t.write(pkt)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		p, err := t.read()
+		if err != nil {
+			// only a read deadline retries, a done context ends the transfer
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// part of the window arrived, acknowledge it without using up a retry
+				if received > 0 {
+					received = 0
+					pkt = AppendAck(ack[:0], block)
+				} else if retries--; retries == 0 {
+					return cw.n, errExhaustedRetries
+				}
+				err = t.write(pkt)
+				if err != nil {
+					return cw.n, err
+				}
+				continue
+			}
+			return cw.n, err
+		}
+		next, payload, dataErr := parseData(p)
+		switch {
+		case dataErr == nil:
+			// a server that ignores our options answers with the first block
+			started = true
+			if next != opts.next(block) {
+				// acknowledge the last block we have so the server resends from
+				// there, the window starts over after it
+				if !nacked {
+					nacked = true
+					received = 0
+					pkt = AppendAck(ack[:0], block)
+					err = t.write(pkt)
+					if err != nil {
+						return cw.n, err
+					}
+				}
+				continue
+			}
+			size := len(p) - 4
+			if size > opts.blockSize {
+				t.abort(ErrIllegalOp, "block too large")
+				return cw.n, errors.New("tftp: block too large")
+			}
+			_, err = w.Write(payload)
+			if err != nil {
+				t.abort(ErrUnknown, "cannot write file")
+				return cw.n, err
+			}
+			block = next
+			blocks++
+			received++
+			nacked = false
+			retries = c.retries()
+			// a block shorter than the block size ends the transfer,
+			// otherwise we acknowledge once the whole window arrived
+			if size < opts.blockSize {
+				pkt = AppendAck(ack[:0], block)
+				_ = t.write(pkt)
+				if dec != nil {
+					err = dec.Close()
+				}
+				return cw.n, err
+			}
+			if received < opts.windowSize {
+				continue
+			}
+			received = 0
+			pkt = AppendAck(ack[:0], block)
+		case oack.UnmarshalBinary(p) == nil:
+			// the server resends its OACK when our ACK 0 got lost
+			if started {
+				if blocks == 0 {
+					err = t.write(pkt)
+					if err != nil {
+						return cw.n, err
+					}
+				}
+				continue
+			}
+			started = true
+			opts, err = c.accept(oack)
+			if err != nil {
+				t.abort(ErrOptNegotiation, err.Error())
+				return cw.n, err
+			}
+			t.grow(opts.blockSize)
+			// ACK 0 confirms the options and starts the transfer
+			pkt = AppendAck(ack[:0], 0)
+		case errPkt.UnmarshalBinary(p) == nil:
+			return cw.n, &RemoteError{Code: errPkt.Error, Message: errPkt.Message}
+		default:
+			t.abort(ErrIllegalOp, "unexpected packet")
+			return cw.n, errUnexpectedPacket
+		}
+		err = t.write(pkt)
+		if err != nil {
+			return cw.n, err
+		}
+	}
+}
+
+// Put writes the contents of r to filename on the server at addr.
+// It returns the number of bytes read from r
+func (c *Client) Put(ctx context.Context, addr, filename string, r io.Reader) (int64, error) {
+	if c.Rollover > 1 {
+		return 0, errors.New("tftp: rollover must be 0 or 1")
+	}
+	mode := c.mode()
+	// announce the size when we know it so the server can refuse the upload up front
+	size := int64(-1)
+	if !strings.EqualFold(mode, ModeNetASCII) {
+		size = sizeOf(r)
+	}
+	req, err := WriteReq{Filename: filename, Mode: mode, Options: c.options(size)}.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	t, err := c.dial(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer t.close()
+
+	cr := &countReader{r: r}
+	r = cr
+	if strings.EqualFold(mode, ModeNetASCII) {
+		r = NewNetASCIIReader(cr)
+	}
+
+	// the server accepts the upload with ACK 0 or an OACK
+	var (
+		opts    = c.defaults()
+		ackPkt  Ack
+		errPkt  ErrReq
+		oack    OAck
+		retries = c.retries()
+	)
+WAIT:
+	for {
+		err = t.write(req)
+		if err != nil {
+			return 0, err
+		}
+		p, err := t.read()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if retries--; retries == 0 {
+					return 0, errExhaustedRetries
+				}
+				continue
+			}
+			return 0, err
+		}
+		switch {
+		case oack.UnmarshalBinary(p) == nil:
+			opts, err = c.accept(oack)
+			if err != nil {
+				t.abort(ErrOptNegotiation, err.Error())
+				return 0, err
+			}
+			break WAIT
+		case ackPkt.UnmarshalBinary(p) == nil && ackPkt == 0:
+			break WAIT
+		case errPkt.UnmarshalBinary(p) == nil:
+			return 0, &RemoteError{Code: errPkt.Error, Message: errPkt.Message}
+		default:
+			t.abort(ErrIllegalOp, "unexpected packet")
+			return 0, errUnexpectedPacket
+		}
+	}
+
+	var (
+		window = make([][]byte, 0, opts.windowSize) // packets in flight, oldest first
+		free   = make([][]byte, 0, opts.windowSize) // packet buffers ready for reuse
+		chunk  = make([]byte, opts.blockSize)
+		first  = opts.next(0) // the oldest block in the window
+		block  uint16         // the last block read from r
+		eof    bool
+	)
+	for i := 0; i < opts.windowSize; i++ {
+		free = append(free, make([]byte, 0, 4+opts.blockSize))
+	}
+	// loop until the short block that ends the transfer was acknowledged
+	for !eof || len(window) > 0 {
+		for !eof && len(window) < opts.windowSize {
+			n, err := io.ReadFull(r, chunk)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				t.abort(ErrUnknown, "cannot read file")
+				return cr.n, err
+			}
+			eof = n < opts.blockSize
+			block = opts.next(block)
+			pkt := AppendData(free[len(free)-1][:0], block, chunk[:n])
+			free = free[:len(free)-1]
+			window = append(window, pkt)
+		}
+		acked, err := c.send(t, window, first, opts)
+		if err != nil {
+			return cr.n, err
+		}
+		for i := 0; i < acked; i++ {
+			first = opts.next(first)
+		}
+		// slide the window past the acknowledged blocks
+		free = append(free, window[:acked]...)
+		window = append(window[:0], window[acked:]...)
+	}
+	return cr.n, nil
+}
+
+// send writes pkts, the packets of consecutive blocks starting with first,
+// to the server and waits for an acknowledgment of one of them.
+// It returns how many packets the server acknowledged
+func (c *Client) send(t *clientConn, pkts [][]byte, first uint16, opts transferOpts) (int, error) {
+	var (
+		ackPkt Ack
+		errPkt ErrReq
+		oack   OAck
+	)
+RETRY:
+	for i := c.retries(); i > 0; i-- {
+		for _, pkt := range pkts {
+			err := t.write(pkt)
+			if err != nil {
+				return 0, err
+			}
+		}
+		for {
+			p, err := t.read()
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					continue RETRY
+				}
+				return 0, err
+			}
+			switch {
+			case ackPkt.UnmarshalBinary(p) == nil:
+				// a stale ACK is ignored and only a timeout resends the window
+				if acked := ackedBlocks(first, uint16(ackPkt), len(pkts), opts); acked > 0 {
+					return acked, nil
+				}
+			case oack.UnmarshalBinary(p) == nil:
+				// the server resends its OACK until it got our first block,
+				// like a stale ACK only a timeout resends the window
+			case errPkt.UnmarshalBinary(p) == nil:
+				return 0, &RemoteError{Code: errPkt.Error, Message: errPkt.Message}
+			default:
+				t.abort(ErrIllegalOp, "unexpected packet")
+				return 0, errUnexpectedPacket
+			}
+		}
+	}
+	t.abort(ErrUnknown, "exhausted retries")
+	return 0, errExhaustedRetries
+}
+
+// options returns the options requested from the server.
+// size is the size of an upload, -1 when unknown
+func (c *Client) options(size int64) map[string]string {
+	options := make(map[string]string)
+	if c.BlockSize != 0 && c.BlockSize != BlockSize {
+		options[OptBlockSize] = strconv.Itoa(c.BlockSize)
+	}
+	if c.WindowSize > 1 {
+		options[OptWindowSize] = strconv.Itoa(int(c.WindowSize))
+	}
+	if secs := c.Timeout / time.Second; secs >= 1 && secs <= 255 {
+		options[OptTimeout] = strconv.Itoa(int(secs))
+	}
+	if size >= 0 {
+		options[OptTransferSize] = strconv.FormatInt(size, 10)
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+// accept checks the options acknowledged by the server against the ones
+// we asked for and returns the transfer parameters they result in
+func (c *Client) accept(oack OAck) (transferOpts, error) {
+	opts := c.defaults()
+	requested := c.options(-1)
+	for name, value := range oack {
+		if name == OptTransferSize {
+			continue
+		}
+		if _, ok := requested[name]; !ok {
+			return opts, fmt.Errorf("tftp: unrequested option %q", name)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("tftp: invalid %s %q", name, value)
+		}
+		switch name {
+		case OptBlockSize:
+			if n < MinBlockSize || n > c.BlockSize {
+				return opts, fmt.Errorf("tftp: invalid %s %q", name, value)
+			}
+			opts.blockSize = n
+		case OptWindowSize:
+			if n < 1 || n > int(c.WindowSize) {
+				return opts, fmt.Errorf("tftp: invalid %s %q", name, value)
+			}
+			opts.windowSize = n
+		}
+	}
+	return opts, nil
+}
+
+// defaults returns the transfer parameters used when the server ignores our options
+func (c *Client) defaults() transferOpts {
+	return transferOpts{blockSize: BlockSize, timeout: c.timeout(), size: -1, windowSize: 1, rollover: c.Rollover}
+}
+
+func (c *Client) mode() string {
+	if c.Mode == "" {
+		return ModeOctet
+	}
+	return c.Mode
+}
+
+func (c *Client) retries() uint8 {
+	if c.Retries == 0 {
+		return 10
+	}
+	return c.Retries
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return time.Second * 6
+	}
+	return c.Timeout
+}
+
+// dial opens the socket used for a single transfer with the server at addr
+func (c *Client) dial(ctx context.Context, addr string) (*clientConn, error) {
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	// closing the socket unblocks a pending read when ctx is done
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	t := &clientConn{
+		ctx:     ctx,
+		conn:    conn,
+		server:  unmap(server.AddrPort()),
+		timeout: c.timeout(),
+		buf:     make([]byte, DatagramSize),
+		stop:    stop,
+	}
+	t.grow(c.BlockSize)
+	return t, nil
+}
+
+// clientConn is the client side of a single transfer
+type clientConn struct {
+	ctx     context.Context
+	conn    *net.UDPConn
+	server  netip.AddrPort // address requests are sent to
+	tid     netip.AddrPort // the port the server answers from, invalid until it does
+	timeout time.Duration
+	buf     []byte
+	stop    func() bool
+}
+
+// grow makes sure the receive buffer holds blocks of size bytes
+func (t *clientConn) grow(size int) {
+	if 4+size > len(t.buf) {
+		t.buf = make([]byte, 4+size)
+	}
+}
+
+// write sends p to the server's transfer ID, or to the server address
+// until the server answered
+func (t *clientConn) write(p []byte) error {
+	addr := t.tid
+	if !addr.IsValid() {
+		addr = t.server
+	}
+	_, err := t.conn.WriteToUDPAddrPort(p, addr)
+	if err != nil && t.ctx.Err() != nil {
+		return t.ctx.Err()
+	}
+	return err
+}
+
+// read waits for the next packet of the transfer.
+// The first packet from the server fixes its transfer ID, packets from
+// any other port are answered with an error without ending the transfer
+func (t *clientConn) read() ([]byte, error) {
+	for {
+		deadline, expires := time.Now().Add(t.timeout), false
+		if d, ok := t.ctx.Deadline(); ok && d.Before(deadline) {
+			deadline, expires = d, true
+		}
+		_ = t.conn.SetReadDeadline(deadline)
+		n, addr, err := t.conn.ReadFromUDPAddrPort(t.buf)
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return nil, t.ctx.Err()
+			}
+			// the read deadline may fire just before the context notices
+			if errors.Is(err, os.ErrDeadlineExceeded) && expires {
+				return nil, context.DeadlineExceeded
+			}
+			return nil, err
+		}
+		addr = unmap(addr)
+		switch {
+		case !t.tid.IsValid():
+			// the server answers from a new port on the address we sent the request to
+			if !t.server.Addr().IsUnspecified() && addr.Addr() != t.server.Addr() {
+				continue
+			}
+			t.tid = addr
+		case addr != t.tid:
+			b, err := ErrReq{Error: ErrUnknownId, Message: "unknown transfer id"}.MarshalBinary()
+			if err == nil {
+				_, _ = t.conn.WriteToUDPAddrPort(b, addr)
+			}
+			continue
+		}
+		if n < 2 {
+			continue
+		}
+		return t.buf[:n], nil
+	}
+}
+
+// abort tells the server we are giving up on the transfer
+func (t *clientConn) abort(code ErrCode, msg string) {
+	if !t.tid.IsValid() {
+		return
+	}
+	b, err := ErrReq{Error: code, Message: msg}.MarshalBinary()
+	if err != nil {
+		return
+	}
+	_ = t.write(b)
+}
+
+func (t *clientConn) close() {
+	t.stop()
+	_ = t.conn.Close()
+}
+
+// sizeOf returns the number of bytes left in r, -1 when unknown
+func sizeOf(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case interface{ Stat() (fs.FileInfo, error) }:
+		info, err := v.Stat()
+		if err == nil && info.Mode().IsRegular() {
+			if s, ok := r.(io.Seeker); ok {
+				off, err := s.Seek(0, io.SeekCurrent)
+				if err == nil {
+					return info.Size() - off
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// countWriter counts the bytes written through it
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countReader counts the bytes read through it
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
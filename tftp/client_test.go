@@ -0,0 +1,188 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// serve starts s on a loopback port and returns its address
+func serve(t testing.TB, s *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(conn) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+		_ = conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestClientGet(t *testing.T) {
+	payload := bytes.Repeat([]byte("line of text\n"), 1000)
+	addr := serve(t, &Server{FS: fstest.MapFS{
+		"file.txt":   {Data: payload},
+		"exact.bin":  {Data: payload[:2048]},
+		"empty.bin":  {},
+		"subdir/a.b": {Data: []byte("nested")},
+	}})
+
+	tests := []struct {
+		name     string
+		client   Client
+		file     string
+		expected []byte
+	}{
+		{"default", Client{}, "file.txt", payload},
+		{"blksize", Client{BlockSize: 1428}, "file.txt", payload},
+		{"windowsize", Client{BlockSize: 1024, WindowSize: 4}, "file.txt", payload},
+		{"exact blocks", Client{BlockSize: 1024}, "exact.bin", payload[:2048]},
+		{"empty", Client{}, "empty.bin", nil},
+		{"nested", Client{}, "subdir/a.b", []byte("nested")},
+		{"netascii", Client{Mode: ModeNetASCII}, "file.txt", payload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			buf := new(bytes.Buffer)
+			n, err := test.client.Get(ctx, addr, test.file, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("expected %d bytes; actual %d", buf.Len(), n)
+			}
+			if !bytes.Equal(buf.Bytes(), test.expected) {
+				t.Errorf("received %d bytes; expected %d", buf.Len(), len(test.expected))
+			}
+		})
+	}
+
+	var c Client
+	_, err := c.Get(context.Background(), addr, "missing", new(bytes.Buffer))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != ErrNotFound {
+		t.Errorf("expected a not found error; actual %v", err)
+	}
+}
+
+// checkStored fails the test unless dir holds name with payload. The server
+// stores an upload before it acknowledges the last block, so the file is
+// complete once Put returned
+func checkStored(t *testing.T, dir, name string, payload []byte) {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(b, payload) {
+		t.Errorf("%s: stored %d bytes; expected %d", name, len(b), len(payload))
+	}
+}
+
+func TestClientPut(t *testing.T) {
+	dir := t.TempDir()
+	addr := serve(t, &Server{Payload: []byte{}, UploadDir: dir})
+	payload := bytes.Repeat([]byte("line of text\n"), 1000)
+
+	tests := []struct {
+		name   string
+		client Client
+	}{
+		{"default", Client{}},
+		{"blksize", Client{BlockSize: 1428}},
+		{"windowsize", Client{BlockSize: 1024, WindowSize: 4}},
+		{"netascii", Client{Mode: ModeNetASCII}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			n, err := test.client.Put(ctx, addr, test.name, bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(payload)) {
+				t.Errorf("expected %d bytes; actual %d", len(payload), n)
+			}
+			checkStored(t, dir, test.name, payload)
+		})
+	}
+
+	var c Client
+	_, err := c.Put(context.Background(), addr, "default", bytes.NewReader(payload))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != ErrFileExists {
+		t.Errorf("expected a file exists error; actual %v", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	// nobody answers on this socket
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var c Client
+	_, err = c.Get(ctx, conn.LocalAddr().String(), "file", new(bytes.Buffer))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded; actual %v", err)
+	}
+}
+
+func TestRollover(t *testing.T) {
+	// 8 byte blocks push the transfer past block 65535
+	payload := make([]byte, 8*70000+3)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for _, rollover := range []uint16{0, 1} {
+		dir := t.TempDir()
+		addr := serve(t, &Server{Payload: payload, UploadDir: dir, Rollover: rollover})
+		c := Client{BlockSize: MinBlockSize, WindowSize: 32, Rollover: rollover}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		buf := new(bytes.Buffer)
+		_, err := c.Get(ctx, addr, "payload", buf)
+		if err != nil {
+			t.Fatalf("rollover %d: get: %v", rollover, err)
+		}
+		if !bytes.Equal(buf.Bytes(), payload) {
+			t.Errorf("rollover %d: received %d bytes; expected %d", rollover, buf.Len(), len(payload))
+		}
+
+		name := fmt.Sprintf("upload-rollover-%d", rollover)
+		_, err = c.Put(ctx, addr, name, bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("rollover %d: put: %v", rollover, err)
+		}
+		checkStored(t, dir, name, payload)
+	}
+
+	// a client rolling over to a different block number than the server stalls
+	addr := serve(t, &Server{Payload: payload, Rollover: 1})
+	c := Client{BlockSize: MinBlockSize, WindowSize: 32, Timeout: 100 * time.Millisecond, Retries: 2}
+	_, err := c.Get(context.Background(), addr, "payload", new(bytes.Buffer))
+	if err == nil {
+		t.Error("expected mismatched rollover to fail")
+	}
+}
@@ -0,0 +1,134 @@
+package tftp
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// fileCache serves files out of fsys and shares the open files among the
+// transfers reading them at the same time. Files are keyed by path,
+// modification time and version of fsys so a replaced file is opened anew
+// while transfers of the old one finish. A file is closed once its last
+// transfer ended
+type fileCache struct {
+	fsys  fs.FS
+	mu    sync.Mutex
+	files map[fileKey]*cachedFile
+}
+
+type fileKey struct {
+	name    string
+	modTime time.Time
+	version uint64
+}
+
+// versioned is a file system, or a file opened from it, telling which
+// version of its contents it serves. A reloaded Archive is a new version
+// even when its members kept their modification times
+type versioned interface {
+	version() uint64
+}
+
+// versionOf returns the version of v, zero when it has none
+func versionOf(v any) uint64 {
+	if v, ok := v.(versioned); ok {
+		return v.version()
+	}
+	return 0
+}
+
+type cachedFile struct {
+	key  fileKey
+	file fs.File
+	size int64
+	refs int // transfers reading the file
+}
+
+func newFileCache(fsys fs.FS) *fileCache {
+	return &fileCache{fsys: fsys, files: make(map[fileKey]*cachedFile)}
+}
+
+func (c *fileCache) ServeTFTP(w ResponseWriter, r *Request) {
+	name, ok := cleanPath(r.Filename)
+	if !ok {
+		w.Error(&fs.PathError{Op: "open", Path: r.Filename, Err: fs.ErrInvalid})
+		return
+	}
+	info, err := fs.Stat(c.fsys, name)
+	if err != nil {
+		w.Error(err)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		w.Error(&fs.PathError{Op: "open", Path: r.Filename, Err: fs.ErrInvalid})
+		return
+	}
+	cf, err := c.open(fileKey{name: name, modTime: info.ModTime(), version: versionOf(c.fsys)})
+	if err != nil {
+		w.Error(err)
+		return
+	}
+	defer c.release(cf)
+	ra, ok := cf.file.(io.ReaderAt)
+	if !ok {
+		// files without ReadAt are read by a single transfer
+		serveContent(w, cf.file, cf.size)
+		return
+	}
+	ReaderAtServer(ra, cf.size).ServeTFTP(w, r)
+}
+
+// open returns the file of key, opening it unless a transfer already did.
+// Files without ReadAt are never shared
+func (c *fileCache) open(key fileKey) (*cachedFile, error) {
+	c.mu.Lock()
+	cf := c.files[key]
+	if cf != nil {
+		cf.refs++
+	}
+	c.mu.Unlock()
+	if cf != nil {
+		return cf, nil
+	}
+
+	f, err := c.fsys.Open(key.name)
+	if err != nil {
+		return nil, err
+	}
+	// the file may have been replaced since we looked it up
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	key = fileKey{name: key.name, modTime: info.ModTime(), version: versionOf(f)}
+	cf = &cachedFile{key: key, file: f, size: info.Size(), refs: 1}
+	if _, ok := f.(io.ReaderAt); !ok {
+		return cf, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// another transfer opened the same file in the meantime
+	if shared := c.files[cf.key]; shared != nil {
+		shared.refs++
+		_ = f.Close()
+		return shared, nil
+	}
+	c.files[cf.key] = cf
+	return cf, nil
+}
+
+// release ends the use of cf by a transfer, the last one closes it
+func (c *fileCache) release(cf *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cf.refs--; cf.refs > 0 {
+		return
+	}
+	if c.files[cf.key] == cf {
+		delete(c.files, cf.key)
+	}
+	_ = cf.file.Close()
+}
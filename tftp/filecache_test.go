@@ -0,0 +1,94 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFS counts the files opened and not closed yet
+type countingFS struct {
+	fs.FS
+	opened atomic.Int32
+	open   atomic.Int32
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	c.opened.Add(1)
+	c.open.Add(1)
+	return &countedFile{File: f, ReaderAt: f.(io.ReaderAt), fsys: c}, nil
+}
+
+func (c *countingFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(c.FS, name)
+}
+
+type countedFile struct {
+	fs.File
+	io.ReaderAt
+	fsys *countingFS
+}
+
+func (f *countedFile) Close() error {
+	f.fsys.open.Add(-1)
+	return f.File.Close()
+}
+
+func TestFileCache(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "payload")
+	image := bytes.Repeat([]byte("image"), 1000)
+	if err := os.WriteFile(name, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fsys := &countingFS{FS: os.DirFS(dir)}
+	s := &Server{FS: fsys}
+	addr := serve(t, s)
+
+	// a transfer waiting for its first ACK keeps the file open
+	holdTransfer(t, addr, "payload")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+	get := func() {
+		t.Helper()
+		buf := new(bytes.Buffer)
+		if _, err := c.Get(ctx, addr, "payload", buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), image) {
+			t.Fatalf("received %d bytes; expected %d", buf.Len(), len(image))
+		}
+	}
+	get()
+	if opened := fsys.opened.Load(); opened != 1 {
+		t.Errorf("concurrent transfers opened the file %d times", opened)
+	}
+
+	// a modified file is opened anew
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	if opened := fsys.opened.Load(); opened != 2 {
+		t.Errorf("opened the file %d times after it was modified; expected 2", opened)
+	}
+
+	shutdown, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+	defer cancelShutdown()
+	_ = s.Shutdown(shutdown)
+	if open := fsys.open.Load(); open != 0 {
+		t.Errorf("%d files left open", open)
+	}
+}
@@ -0,0 +1,194 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"sync"
+)
+
+// Handler answers read requests. Write requests are stored in UploadDir
+type Handler interface {
+	ServeTFTP(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+func (f HandlerFunc) ServeTFTP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// ResponseWriter sends the file a client asked for. The transfer ends
+// with the handler: whatever was written is the whole file
+type ResponseWriter interface {
+	// Write sends p to the client, it fails once the transfer failed
+	Write(p []byte) (int, error)
+	// SetSize announces the size of the file so the tsize option can be
+	// answered, it has no effect after the first Write
+	SetSize(size int64)
+	// Error aborts the transfer with an error packet. Errors wrapping
+	// fs.ErrNotExist, fs.ErrPermission and fs.ErrInvalid are sent with
+	// their matching error codes
+	Error(err error)
+}
+
+// Request is a read request received by the server
+type Request struct {
+	Filename   string
+	Mode       string
+	Options    map[string]string // options the client asked for, names are lower case
+	RemoteAddr net.Addr
+	ctx        context.Context
+}
+
+// Context is done once the server aborts the transfer
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// handler returns the Handler serving read requests. The handler of FS
+// is kept so its transfers share the open files
+func (s *Server) handler() Handler {
+	switch {
+	case s.Handler != nil:
+		return s.Handler
+	case s.FS != nil:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.files == nil {
+			s.files = FileServer(s.FS)
+		}
+		return s.files
+	default:
+		return PayloadServer(s.Payload)
+	}
+}
+
+// FileServer returns a handler serving regular files out of fsys.
+// Absolute paths and ".." elements are refused. Files are streamed, the
+// transfers of a file share a single open file when it implements io.ReaderAt
+func FileServer(fsys fs.FS) Handler {
+	return newFileCache(fsys)
+}
+
+// PayloadServer returns a handler answering every read request with payload
+func PayloadServer(payload []byte) Handler {
+	return ReaderAtServer(bytes.NewReader(payload), int64(len(payload)))
+}
+
+// ReaderAtServer returns a handler answering every read request with the
+// size bytes of r, such as an *os.File or a memory mapped file.
+// Transfers read r concurrently without holding a copy of it
+func ReaderAtServer(r io.ReaderAt, size int64) Handler {
+	return HandlerFunc(func(w ResponseWriter, _ *Request) {
+		serveContent(w, io.NewSectionReader(r, 0, size), size)
+	})
+}
+
+// serveContent sends size bytes read from r
+func serveContent(w ResponseWriter, r io.Reader, size int64) {
+	w.SetSize(size)
+	_, err := io.Copy(w, r)
+	if err != nil {
+		w.Error(err)
+	}
+}
+
+// ServeMux dispatches read requests to the handler registered for the
+// requested filename. Patterns use the syntax of path.Match, a handler
+// registered for the exact filename wins over patterns and patterns are
+// tried in the order they were registered
+type ServeMux struct {
+	mu       sync.RWMutex
+	exact    map[string]Handler
+	patterns []muxEntry
+}
+
+type muxEntry struct {
+	pattern string
+	handler Handler
+}
+
+// NewServeMux allocates and returns a new ServeMux
+func NewServeMux() *ServeMux {
+	return &ServeMux{exact: make(map[string]Handler)}
+}
+
+// Handle registers the handler for pattern. It panics when the pattern is
+// malformed or already registered
+func (m *ServeMux) Handle(pattern string, handler Handler) {
+	if handler == nil {
+		panic("tftp: nil handler")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic(fmt.Sprintf("tftp: invalid pattern %q: %v", pattern, err))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.exact == nil {
+		m.exact = make(map[string]Handler)
+	}
+	if _, ok := m.exact[pattern]; ok {
+		panic(fmt.Sprintf("tftp: multiple registrations for %q", pattern))
+	}
+	for _, e := range m.patterns {
+		if e.pattern == pattern {
+			panic(fmt.Sprintf("tftp: multiple registrations for %q", pattern))
+		}
+	}
+	if !hasMeta(pattern) {
+		m.exact[pattern] = handler
+		return
+	}
+	m.patterns = append(m.patterns, muxEntry{pattern: pattern, handler: handler})
+}
+
+// HandleFunc registers the handler function for pattern
+func (m *ServeMux) HandleFunc(pattern string, handler func(w ResponseWriter, r *Request)) {
+	m.Handle(pattern, HandlerFunc(handler))
+}
+
+// Handler returns the handler for filename, nil when nothing matches
+func (m *ServeMux) Handler(filename string) Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if h, ok := m.exact[filename]; ok {
+		return h
+	}
+	for _, e := range m.patterns {
+		if ok, _ := path.Match(e.pattern, filename); ok {
+			return e.handler
+		}
+	}
+	return nil
+}
+
+// ServeTFTP dispatches the request to the matching handler,
+// a filename nothing matches is not found
+func (m *ServeMux) ServeTFTP(w ResponseWriter, r *Request) {
+	h := m.Handler(r.Filename)
+	if h == nil {
+		w.Error(&fs.PathError{Op: "open", Path: r.Filename, Err: fs.ErrNotExist})
+		return
+	}
+	h.ServeTFTP(w, r)
+}
+
+// hasMeta reports whether pattern holds any of the special characters of path.Match
+func hasMeta(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
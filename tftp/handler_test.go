@@ -0,0 +1,86 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeMux(t *testing.T) {
+	loader := bytes.Repeat([]byte{0xAA}, 2000)
+	mux := NewServeMux()
+	mux.Handle("pxelinux.0", PayloadServer(loader))
+	mux.HandleFunc("pxelinux.cfg/01-*", func(w ResponseWriter, r *Request) {
+		// generated content written a byte at a time across block boundaries
+		config := strings.Repeat(fmt.Sprintf("config for %s\n", r.Filename), 100)
+		w.SetSize(int64(len(config)))
+		for i := 0; i < len(config); i++ {
+			_, err := w.Write([]byte{config[i]})
+			if err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("pxelinux.cfg/*", func(w ResponseWriter, r *Request) {
+		w.Error(fs.ErrPermission)
+	})
+	addr := serve(t, &Server{Handler: mux})
+
+	tests := []struct {
+		name     string
+		client   Client
+		file     string
+		expected string
+		code     ErrCode
+	}{
+		{"exact", Client{}, "pxelinux.0", string(loader), 0},
+		{"pattern", Client{BlockSize: 1024}, "pxelinux.cfg/01-aa-bb", strings.Repeat("config for pxelinux.cfg/01-aa-bb\n", 100), 0},
+		{"netascii", Client{Mode: ModeNetASCII}, "pxelinux.cfg/01-cc", strings.Repeat("config for pxelinux.cfg/01-cc\n", 100), 0},
+		{"registration order", Client{}, "pxelinux.cfg/default", "", ErrAccessViolation},
+		{"not found", Client{}, "missing", "", ErrNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			buf := new(bytes.Buffer)
+			_, err := test.client.Get(ctx, addr, test.file, buf)
+			if test.code != 0 {
+				var remote *RemoteError
+				if !errors.As(err, &remote) || remote.Code != test.code {
+					t.Errorf("expected error code %d; actual %v", test.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := buf.String(); actual != test.expected {
+				t.Errorf("received %d bytes; expected %d", len(actual), len(test.expected))
+			}
+		})
+	}
+}
+
+func TestServeMuxRegistration(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("a", PayloadServer(nil))
+	for _, pattern := range []string{"a", "["} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a panic registering %q", pattern)
+				}
+			}()
+			mux.Handle(pattern, PayloadServer(nil))
+		}()
+	}
+	if mux.Handler("b") != nil {
+		t.Error("unexpected handler for b")
+	}
+}
@@ -0,0 +1,151 @@
+package tftp
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket handing out bytes at a steady rate.
+// It lets a second worth of bytes through in a burst
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // bytes that may be sent right away, negative when reserved ahead
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n bytes may be sent or ctx is done. Bytes are reserved
+// right away so concurrent callers queue up behind each other
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// throttle paces a transfer by the limiters of the server and of its client
+type throttle []*rateLimiter
+
+// wait blocks until n bytes may be sent by every limiter
+func (t throttle) wait(ctx context.Context, n int) error {
+	for _, l := range t {
+		if err := l.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientLimiter is the limiter shared by the transfers of one client
+type clientLimiter struct {
+	*rateLimiter
+	transfers int
+}
+
+// throttle returns the limiters a transfer with the client at addr is
+// subject to. release must be called once the transfer ended
+func (s *Server) throttle(addr net.Addr) (t throttle, release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RateLimit > 0 {
+		if s.rate == nil {
+			s.rate = newRateLimiter(s.RateLimit)
+		}
+		t = append(t, s.rate)
+	}
+	client, ok := clientIP(addr)
+	if s.ClientRateLimit <= 0 || !ok {
+		return t, func() {}
+	}
+	if s.clientRates == nil {
+		s.clientRates = make(map[netip.Addr]*clientLimiter)
+	}
+	l := s.clientRates[client]
+	if l == nil {
+		l = &clientLimiter{rateLimiter: newRateLimiter(s.ClientRateLimit)}
+		s.clientRates[client] = l
+	}
+	l.transfers++
+	// forget the client once its last transfer ended
+	release = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if l.transfers--; l.transfers == 0 {
+			delete(s.clientRates, client)
+		}
+	}
+	return append(t, l.rateLimiter), release
+}
+
+// admit waits for one of the MaxTransfers slots for a request from addr
+// received on conn. Requests still waiting after QueueTimeout are refused
+// with an error packet. release must be called once the transfer ended
+func (s *Server) admit(ctx context.Context, conn net.PacketConn, addr net.Addr) (release func(), ok bool) {
+	if s.slots == nil {
+		return func() {}, true
+	}
+	release = func() { <-s.slots }
+	select {
+	case s.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	// the client resends its request while it waits, the copies are dropped
+	key := addr.String()
+	s.mu.Lock()
+	if _, ok := s.queued[key]; ok {
+		s.mu.Unlock()
+		return nil, false
+	}
+	s.queued[key] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.queued, key)
+		s.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(s.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		log.Printf("[%s] refused: too many transfers", addr)
+		replyErr(conn, addr, ErrUnknown, "too many transfers, try again later")
+	case <-ctx.Done():
+	}
+	return nil, false
+}
+
+// clientIP returns the IP address of a client, IPv4 addresses are never mapped to IPv6
+func clientIP(addr net.Addr) (netip.Addr, bool) {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	ip, ok := netip.AddrFromSlice(a.IP)
+	return ip.Unmap(), ok
+}
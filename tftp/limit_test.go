@@ -0,0 +1,112 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, 60*1024)
+	tests := []struct {
+		name   string
+		server *Server
+	}{
+		{"global", &Server{Payload: payload, RateLimit: 30 * 1024}},
+		{"client", &Server{Payload: payload, ClientRateLimit: 30 * 1024}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := serve(t, test.server)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			c := Client{BlockSize: 1024, WindowSize: 4}
+			start := time.Now()
+			buf := new(bytes.Buffer)
+			_, err := c.Get(ctx, addr, "payload", buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), payload) {
+				t.Fatalf("received %d bytes; expected %d", buf.Len(), len(payload))
+			}
+			// a second worth of bytes goes out right away, the rest takes another second
+			if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+				t.Errorf("transfer took %v; expected about a second", elapsed)
+			}
+		})
+	}
+}
+
+// holdTransfer requests a file from the server at addr and never
+// acknowledges it, the transfer stays in flight until ack is called
+func holdTransfer(t *testing.T, addr, filename string) (ack func()) {
+	t.Helper()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrq, err := ReadReq{Filename: filename, Mode: ModeOctet}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.WriteTo(rrq, server); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, DatagramSize)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	_, tid, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		pkt, _ := Ack(1).MarshalBinary()
+		_, _ = client.WriteTo(pkt, tid)
+	}
+}
+
+func TestMaxTransfers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var c Client
+
+	// without a queue requests over the limit are refused
+	addr := serve(t, &Server{Payload: []byte("payload"), MaxTransfers: 1})
+	ack := holdTransfer(t, addr, "payload")
+	var remote *RemoteError
+	_, err := c.Get(ctx, addr, "payload", new(bytes.Buffer))
+	if !errors.As(err, &remote) || remote.Code != ErrUnknown {
+		t.Errorf("expected the request to be refused; actual %v", err)
+	}
+	ack()
+
+	// queued requests start once a transfer ended
+	addr = serve(t, &Server{Payload: []byte("payload"), MaxTransfers: 1, QueueTimeout: 5 * time.Second})
+	ack = holdTransfer(t, addr, "payload")
+	done := make(chan error, 1)
+	buf := new(bytes.Buffer)
+	go func() {
+		_, err := c.Get(ctx, addr, "payload", buf)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("expected the request to wait; actual %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	ack()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "payload" {
+		t.Errorf("received %q", buf.String())
+	}
+}
@@ -0,0 +1,255 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mangler relays the packets of one transfer between a client and a server
+// and lets a test duplicate or reorder them on the way.
+// The mangle functions return the packets delivered in place of p
+type mangler struct {
+	front    net.PacketConn // the client sends to this socket
+	back     net.PacketConn // relays to the server
+	toServer func(p []byte) [][]byte
+	toClient func(p []byte) [][]byte
+
+	mu         sync.Mutex
+	server     net.Addr       // the server's listen address until it answers from its transfer ID
+	client     net.Addr       // the client's transfer ID
+	fromServer map[OpCode]int // packets sent by the server before mangling
+	fromClient map[OpCode]int // packets sent by the client before mangling
+}
+
+// newMangler relays between the mangler's address and server.
+// nil mangle functions deliver packets unchanged
+func newMangler(t *testing.T, server string, toServer, toClient func(p []byte) [][]byte) *mangler {
+	t.Helper()
+	front, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchanged := func(p []byte) [][]byte { return [][]byte{p} }
+	if toServer == nil {
+		toServer = unchanged
+	}
+	if toClient == nil {
+		toClient = unchanged
+	}
+	m := &mangler{
+		front:      front,
+		back:       back,
+		toServer:   toServer,
+		toClient:   toClient,
+		server:     addr,
+		fromServer: make(map[OpCode]int),
+		fromClient: make(map[OpCode]int),
+	}
+	t.Cleanup(func() {
+		_ = front.Close()
+		_ = back.Close()
+	})
+	go m.relay(front, back, m.toServer, m.fromClient, func(a net.Addr) net.Addr {
+		m.client = a
+		return m.server
+	})
+	go m.relay(back, front, m.toClient, m.fromServer, func(a net.Addr) net.Addr {
+		m.server = a
+		return m.client
+	})
+	return m
+}
+
+// addr returns the address clients send their requests to
+func (m *mangler) addr() string {
+	return m.front.LocalAddr().String()
+}
+
+// relay copies packets read from src to dst counting them by op code.
+// route records the sender and returns the address the packets are relayed to
+func (m *mangler) relay(src, dst net.PacketConn, mangle func(p []byte) [][]byte, counts map[OpCode]int, route func(net.Addr) net.Addr) {
+	buf := make([]byte, 4+MaxBlockSize)
+	for {
+		n, addr, err := src.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p := append([]byte(nil), buf[:n]...)
+		m.mu.Lock()
+		to := route(addr)
+		if n >= 2 {
+			counts[OpCode(binary.BigEndian.Uint16(p))]++
+		}
+		m.mu.Unlock()
+		for _, pkt := range mangle(p) {
+			_, _ = dst.WriteTo(pkt, to)
+		}
+	}
+}
+
+// serverSent returns how many packets with op the server sent
+func (m *mangler) serverSent(op OpCode) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fromServer[op]
+}
+
+// clientSent returns how many packets with op the client sent
+func (m *mangler) clientSent(op OpCode) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fromClient[op]
+}
+
+// duplicate delivers every packet with op twice
+func duplicate(op OpCode) func(p []byte) [][]byte {
+	return func(p []byte) [][]byte {
+		if OpCode(binary.BigEndian.Uint16(p)) == op {
+			return [][]byte{p, p}
+		}
+		return [][]byte{p}
+	}
+}
+
+// swap delivers the packets with op in pairs, the second one first
+func swap(op OpCode) func(p []byte) [][]byte {
+	var held []byte
+	return func(p []byte) [][]byte {
+		if OpCode(binary.BigEndian.Uint16(p)) != op {
+			return [][]byte{p}
+		}
+		if held == nil {
+			held = p
+			return nil
+		}
+		pkts := [][]byte{p, held}
+		held = nil
+		return pkts
+	}
+}
+
+// drop loses the first packet with op for block
+func drop(op OpCode, block uint16) func(p []byte) [][]byte {
+	dropped := false
+	return func(p []byte) [][]byte {
+		if dropped || OpCode(binary.BigEndian.Uint16(p)) != op || binary.BigEndian.Uint16(p[2:]) != block {
+			return [][]byte{p}
+		}
+		dropped = true
+		return nil
+	}
+}
+
+func TestDuplicateAcks(t *testing.T) {
+	const blocks = 200
+	payload := bytes.Repeat([]byte{'x'}, blocks*BlockSize+1)
+	m := newMangler(t, serve(t, &Server{Payload: payload}), duplicate(OpAck), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var c Client
+	buf := new(bytes.Buffer)
+	_, err := c.Get(ctx, m.addr(), "payload", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Fatalf("received %d bytes; expected %d", buf.Len(), len(payload))
+	}
+	// duplicate ACKs must not make the server send a block twice
+	if sent := m.serverSent(OpData); sent > blocks+1 {
+		t.Errorf("server sent %d data packets for %d blocks", sent, blocks+1)
+	}
+}
+
+func TestDuplicateUploadAcks(t *testing.T) {
+	const blocks = 200
+	payload := bytes.Repeat([]byte{'x'}, blocks*BlockSize+1)
+	dir := t.TempDir()
+	m := newMangler(t, serve(t, &Server{Payload: []byte{}, UploadDir: dir}), nil, duplicate(OpAck))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var c Client
+	_, err := c.Put(ctx, m.addr(), "upload", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// duplicate ACKs must not make the client send a block twice
+	if sent := m.clientSent(OpData); sent > blocks+1 {
+		t.Errorf("client sent %d data packets for %d blocks", sent, blocks+1)
+	}
+	checkStored(t, dir, "upload", payload)
+}
+
+func TestReorderedPackets(t *testing.T) {
+	payload := make([]byte, 16*1024+7)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	dir := t.TempDir()
+	s := &Server{Payload: payload, UploadDir: dir, Timeout: 200 * time.Millisecond}
+	m := newMangler(t, serve(t, s), nil, swap(OpData))
+	c := Client{BlockSize: 1024, WindowSize: 8, Timeout: 200 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	buf := new(bytes.Buffer)
+	_, err := c.Get(ctx, m.addr(), "payload", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Errorf("received %d bytes; expected %d", buf.Len(), len(payload))
+	}
+
+	m = newMangler(t, serve(t, &Server{Payload: []byte{}, UploadDir: dir, Timeout: 200 * time.Millisecond}), swap(OpData), nil)
+	_, err = c.Put(ctx, m.addr(), "upload", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, dir, "upload", payload)
+}
+
+func TestLostBlockRecovery(t *testing.T) {
+	payload := make([]byte, 16*1024+7)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	m := newMangler(t, serve(t, &Server{Payload: payload}), nil, drop(OpData, 3))
+	// the timeout is negotiated, neither side shortens it
+	c := Client{BlockSize: 1024, WindowSize: 8, Timeout: 2 * time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	buf := new(bytes.Buffer)
+	_, err := c.Get(ctx, m.addr(), "payload", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Errorf("received %d bytes; expected %d", buf.Len(), len(payload))
+	}
+	// block 4 arriving in place of block 3 is answered by ACK 2 and the
+	// server resends from block 3 right away instead of after a timeout
+	if d := time.Since(start); d > c.Timeout/4 {
+		t.Errorf("recovering the lost block took %v", d)
+	}
+	if sent := m.serverSent(OpData); sent > 17+8 {
+		t.Errorf("server sent %d data packets for 17 blocks", sent)
+	}
+}
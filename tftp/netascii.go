@@ -0,0 +1,124 @@
+package tftp
+
+import (
+	"bufio"
+	"io"
+)
+
+// transfer modes
+const (
+	ModeOctet    = "octet"    // raw bytes
+	ModeNetASCII = "netascii" // text with CR LF line endings (RFC 764)
+)
+
+// netasciiReader encodes the text it reads into netascii.
+// LF becomes CR LF and a bare CR becomes CR NUL
+type netasciiReader struct {
+	r       *bufio.Reader
+	next    byte // second byte of an encoded pair
+	hasNext bool
+}
+
+// NewNetASCIIReader returns a reader that encodes the text read from r into netascii
+func NewNetASCIIReader(r io.Reader) io.Reader {
+	return &netasciiReader{r: bufio.NewReader(r)}
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	i := 0
+	for ; i < len(p); i++ {
+		// finish the pair started by the previous byte
+		if n.hasNext {
+			p[i], n.hasNext = n.next, false
+			continue
+		}
+		c, err := n.r.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, err
+		}
+		switch c {
+		case '\n':
+			p[i], n.next, n.hasNext = '\r', '\n', true
+		case '\r':
+			p[i], n.next, n.hasNext = '\r', 0, true
+		default:
+			p[i] = c
+		}
+	}
+	return i, nil
+}
+
+// netasciiWriter decodes the netascii written to it.
+// CR LF becomes LF and CR NUL becomes CR
+type netasciiWriter struct {
+	w   io.Writer
+	cr  bool   // the last byte written was a CR
+	buf []byte // decoded bytes, reused across writes
+}
+
+// NewNetASCIIWriter returns a writer that decodes netascii before writing it to w.
+// A CR may pair with the first byte of the next write so the writer must be
+// closed to flush a trailing CR
+func NewNetASCIIWriter(w io.Writer) io.WriteCloser {
+	return &netasciiWriter{w: w}
+}
+
+func (n *netasciiWriter) Write(p []byte) (int, error) {
+	out := n.buf[:0]
+	for _, c := range p {
+		if n.cr {
+			n.cr = false
+			switch c {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				// a bare CR is invalid netascii, we keep it as is
+				out = append(out, '\r')
+			}
+		}
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+	n.buf = out
+	_, err := n.w.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes a CR held back by the last write, it does not close the underlying writer
+func (n *netasciiWriter) Close() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	_, err := n.w.Write([]byte{'\r'})
+	return err
+}
+
+// appendNetASCII appends p encoded as netascii to dst.
+// Unlike decoding, encoding needs no state between calls
+func appendNetASCII(dst, p []byte) []byte {
+	for _, c := range p {
+		switch c {
+		case '\n':
+			dst = append(dst, '\r', '\n')
+		case '\r':
+			dst = append(dst, '\r', 0)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
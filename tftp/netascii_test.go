@@ -0,0 +1,47 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestNetASCII(t *testing.T) {
+	tests := []struct {
+		text     string
+		netascii string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"line\n", "line\r\n"},
+		{"a\nb\n\n", "a\r\nb\r\n\r\n"},
+		{"cr\r", "cr\r\x00"},
+		{"\r\n", "\r\x00\r\n"},
+	}
+	for _, test := range tests {
+		b, err := io.ReadAll(NewNetASCIIReader(bytes.NewBufferString(test.text)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := string(b); actual != test.netascii {
+			t.Errorf("encoding %q: expected %q; actual %q", test.text, test.netascii, actual)
+		}
+
+		// write one byte at a time so CR pairs are split across writes
+		buf := new(bytes.Buffer)
+		w := NewNetASCIIWriter(buf)
+		for i := 0; i < len(test.netascii); i++ {
+			_, err = w.Write([]byte{test.netascii[i]})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := buf.String(); actual != test.text {
+			t.Errorf("decoding %q: expected %q; actual %q", test.netascii, test.text, actual)
+		}
+	}
+}
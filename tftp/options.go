@@ -0,0 +1,83 @@
+package tftp
+
+import (
+	"strconv"
+	"time"
+)
+
+// option names understood by the server
+const (
+	OptBlockSize    = "blksize"    // RFC 2348 block size
+	OptTimeout      = "timeout"    // RFC 2349 retransmission timeout in seconds
+	OptTransferSize = "tsize"      // RFC 2349 transfer size in bytes
+	OptWindowSize   = "windowsize" // RFC 7440 number of blocks sent before waiting for an ACK
+)
+
+// transferOpts holds the transfer parameters agreed on with the client
+type transferOpts struct {
+	blockSize  int           // payload bytes per data packet
+	timeout    time.Duration // initial waiting duration of an acknowledgment or data packet
+	fixed      bool          // the client chose the timeout, it is not adapted to the round-trip time
+	size       int64         // size of the file, -1 when unknown
+	windowSize int           // number of data packets in flight
+	rollover   uint16        // block number following 65535
+}
+
+// next returns the block number following b
+func (o transferOpts) next(b uint16) uint16 {
+	if b == 65535 {
+		return o.rollover
+	}
+	return b + 1
+}
+
+// negotiate picks the requested options the server supports and returns
+// the OACK to answer with. size is the size of the file being read and
+// is ignored for write requests, where the client tells us the size.
+// An empty OACK means the client asked for nothing we support and the
+// transfer follows plain RFC 1350
+func (s *Server) negotiate(op OpCode, req map[string]string, size int64) (OAck, transferOpts) {
+	oack := make(OAck)
+	opts := transferOpts{blockSize: BlockSize, timeout: s.Timeout, size: -1, windowSize: 1, rollover: s.Rollover}
+
+	if v, ok := req[OptBlockSize]; ok {
+		// values out of range are ignored, bigger values are answered with
+		// the largest size we support as RFC 2348 allows
+		n, err := strconv.Atoi(v)
+		if err == nil && n >= MinBlockSize {
+			opts.blockSize = min(n, MaxBlockSize)
+			oack[OptBlockSize] = strconv.Itoa(opts.blockSize)
+		}
+	}
+	if v, ok := req[OptTimeout]; ok {
+		n, err := strconv.Atoi(v)
+		if err == nil && n >= 1 && n <= 255 {
+			opts.timeout, opts.fixed = time.Duration(n)*time.Second, true
+			oack[OptTimeout] = strconv.Itoa(n)
+		}
+	}
+	if v, ok := req[OptTransferSize]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		switch {
+		case err != nil || n < 0:
+		case op == OpWRQ:
+			// the client announces the size of the upload
+			opts.size = n
+			oack[OptTransferSize] = strconv.FormatInt(n, 10)
+		case size >= 0:
+			// the client asks for the size of the file, we can only
+			// answer it when we know the size up front
+			opts.size = size
+			oack[OptTransferSize] = strconv.FormatInt(size, 10)
+		}
+	}
+	if v, ok := req[OptWindowSize]; ok {
+		// like blksize we answer bigger windows with the largest one we allow
+		n, err := strconv.Atoi(v)
+		if err == nil && n >= 1 && n <= 65535 {
+			opts.windowSize = min(n, int(s.MaxWindowSize))
+			oack[OptWindowSize] = strconv.Itoa(opts.windowSize)
+		}
+	}
+	return oack, opts
+}
@@ -0,0 +1,148 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// requestOptions sends a read request for payload with options and
+// returns the client, the server's transfer ID and the OACK
+func requestOptions(t *testing.T, addr net.Addr, options map[string]string) (*rawClient, net.Addr, OAck) {
+	t.Helper()
+	c := newRawClient(t)
+	rrq, err := ReadReq{Filename: "payload", Mode: "octet", Options: options}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, addr)
+	pkt, tid := c.receive()
+	var oack OAck
+	if err = oack.UnmarshalBinary(pkt); err != nil {
+		t.Fatalf("expected an OACK; actual %v", err)
+	}
+	return c, tid, oack
+}
+
+func TestTransferSizeOption(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, 3*BlockSize+100)
+	addr := listen(t, &Server{FS: fstest.MapFS{"payload": {Data: payload}}})
+
+	// a read request asking for the size with tsize=0 is told the size
+	c, tid, oack := requestOptions(t, addr, map[string]string{OptTransferSize: "0"})
+	if v := oack[OptTransferSize]; v != strconv.Itoa(len(payload)) {
+		t.Errorf("expected tsize %d; actual %q", len(payload), v)
+	}
+	c.abort(tid)
+}
+
+func TestTimeoutOption(t *testing.T) {
+	addr := listen(t, &Server{Payload: []byte("payload"), Timeout: 5 * time.Second})
+
+	c, tid, oack := requestOptions(t, addr, map[string]string{OptTimeout: "1"})
+	if v := oack[OptTimeout]; v != "1" {
+		t.Errorf("expected timeout 1; actual %q", v)
+	}
+	// the OACK is resent after the negotiated timeout instead of the server's
+	start := time.Now()
+	_ = c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := c.conn.ReadFrom(c.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if err = oack.UnmarshalBinary(c.buf[:n]); err != nil {
+		t.Fatalf("expected the OACK again; actual %v", err)
+	}
+	if elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected a retransmission after 1s; actual %v", elapsed)
+	}
+	c.abort(tid)
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	addr := listen(t, &Server{Payload: []byte{}, UploadDir: t.TempDir(), MaxUploadSize: 2 * BlockSize})
+	c := newRawClient(t)
+
+	// an upload announced too big is refused up front
+	wrq, err := WriteReq{Filename: "announced", Mode: "octet",
+		Options: map[string]string{OptTransferSize: strconv.Itoa(3 * BlockSize)}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(wrq, addr)
+	pkt, _ := c.receive()
+	c.expectError(pkt, ErrDiskFull)
+
+	// an upload without tsize is refused once it grows too big
+	wrq, err = WriteReq{Filename: "unannounced", Mode: "octet"}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(wrq, addr)
+	pkt, tid := c.receive()
+	c.expectAck(pkt, 0)
+	block := bytes.Repeat([]byte{'x'}, BlockSize)
+	for i := uint16(1); i <= 2; i++ {
+		c.send(dataPacket(i, block), tid)
+		pkt, _ = c.receive()
+		c.expectAck(pkt, i)
+	}
+	c.send(dataPacket(3, block), tid)
+	pkt, _ = c.receive()
+	c.expectError(pkt, ErrDiskFull)
+}
+
+func TestWindowGoBackN(t *testing.T) {
+	payload := make([]byte, 10*BlockSize+100)
+	for i := range payload {
+		payload[i] = byte(i / BlockSize)
+	}
+	addr := listen(t, &Server{FS: fstest.MapFS{"payload": {Data: payload}}})
+	c, tid, oack := requestOptions(t, addr, map[string]string{OptWindowSize: "4"})
+	if v := oack[OptWindowSize]; v != "4" {
+		t.Fatalf("expected windowsize 4; actual %q", v)
+	}
+	ack := func(block uint16) {
+		t.Helper()
+		pkt, err := Ack(block).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(pkt, tid)
+	}
+	// window reads the next n blocks sent by the server
+	window := func(n int) []uint16 {
+		t.Helper()
+		var blocks []uint16
+		for range n {
+			pkt, _ := c.receive()
+			var data Data
+			if err := data.UnmarshalBinary(pkt); err != nil {
+				t.Fatal(err)
+			}
+			p, _ := io.ReadAll(data.Payload)
+			if len(p) == 0 || p[0] != byte(data.Block-1) {
+				t.Fatalf("block %d carries the wrong data", data.Block)
+			}
+			blocks = append(blocks, data.Block)
+		}
+		return blocks
+	}
+
+	ack(0)
+	if blocks := window(4); !slices.Equal(blocks, []uint16{1, 2, 3, 4}) {
+		t.Fatalf("expected blocks 1-4; actual %v", blocks)
+	}
+	// block 2 was lost, acknowledging block 1 restarts the window from block 2
+	ack(1)
+	if blocks := window(4); !slices.Equal(blocks, []uint16{2, 3, 4, 5}) {
+		t.Fatalf("expected blocks 2-5; actual %v", blocks)
+	}
+	c.abort(tid)
+}
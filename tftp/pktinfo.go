@@ -0,0 +1,42 @@
+package tftp
+
+import (
+	"log"
+	"net"
+)
+
+// requestReader reads requests along with the local address they were
+// sent to, so multi-homed hosts answer from the address the client expects
+type requestReader struct {
+	conn net.PacketConn
+	udp  *net.UDPConn // set when the kernel reports the destination of packets
+	oob  []byte
+}
+
+func newRequestReader(conn net.PacketConn) *requestReader {
+	r := &requestReader{conn: conn}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return r
+	}
+	if err := enablePacketInfo(udp); err != nil {
+		log.Printf("replies leave from the address the kernel picks: %v", err)
+		return r
+	}
+	r.udp, r.oob = udp, make([]byte, 128)
+	return r
+}
+
+// read reads a request into p. local is the address the request was sent
+// to with port zero, nil when it is unknown
+func (r *requestReader) read(p []byte) (n int, addr net.Addr, local *net.UDPAddr, err error) {
+	if r.udp == nil {
+		n, addr, err = r.conn.ReadFrom(p)
+		return n, addr, nil, err
+	}
+	n, oobn, _, from, err := r.udp.ReadMsgUDP(p, r.oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, from, packetDestination(r.oob[:oobn]), nil
+}
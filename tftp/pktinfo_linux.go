@@ -0,0 +1,63 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// enablePacketInfo asks the kernel to hand out the destination address of
+// every packet read from conn. IPv6 sockets also receive IPv4 packets so
+// both options are set and it fails only when neither could be
+func enablePacketInfo(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var err4, err6 error
+	err = raw.Control(func(fd uintptr) {
+		err4 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+		err6 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// packetDestination returns the local address of a packet read with the
+// control messages oob, nil when they do not tell
+func packetDestination(oob []byte) *net.UDPAddr {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_PKTINFO &&
+			len(msg.Data) >= unix.SizeofInet4Pktinfo:
+			// struct in_pktinfo: the interface index, the local address
+			// replies go out from and the destination of the packet.
+			// The local address stays usable for broadcast requests
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), msg.Data[4:8]...))}
+		case msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_PKTINFO &&
+			len(msg.Data) >= unix.SizeofInet6Pktinfo:
+			// struct in6_pktinfo: the destination of the packet and the interface index
+			ip := net.IP(append([]byte(nil), msg.Data[:16]...))
+			if ip.IsMulticast() {
+				return nil
+			}
+			addr := &net.UDPAddr{IP: ip}
+			if ip.IsLinkLocalUnicast() {
+				addr.Zone = strconv.FormatUint(uint64(binary.NativeEndian.Uint32(msg.Data[16:20])), 10)
+			}
+			return addr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package tftp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplyFromRequestAddress(t *testing.T) {
+	// the whole of 127.0.0.0/8 is local, a request sent to 127.0.0.2 must
+	// be answered from it although the kernel would pick 127.0.0.1
+	for _, listen := range []string{"0.0.0.0:0", ":0"} {
+		t.Run(listen, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", listen)
+			if err != nil {
+				t.Skip(err)
+			}
+			s := &Server{Payload: []byte("payload")}
+			go func() { _ = s.Serve(conn) }()
+			t.Cleanup(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				_ = s.Shutdown(ctx)
+				_ = conn.Close()
+			})
+
+			client, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = client.Close() }()
+			rrq, err := ReadReq{Filename: "payload", Mode: ModeOctet}.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+			if _, err = client.WriteTo(rrq, server); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, DatagramSize)
+			_ = client.SetReadDeadline(time.Now().Add(time.Second))
+			n, tid, err := client.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data Data
+			if err = data.UnmarshalBinary(buf[:n]); err != nil {
+				t.Fatal(err)
+			}
+			if ip := tid.(*net.UDPAddr).IP; !ip.Equal(server.IP) {
+				t.Errorf("reply sent from %s; expected %s", ip, server.IP)
+			}
+			ack, _ := Ack(data.Block).MarshalBinary()
+			_, _ = client.WriteTo(ack, tid)
+		})
+	}
+}
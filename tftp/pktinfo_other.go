@@ -0,0 +1,18 @@
+//go:build !linux
+
+package tftp
+
+import (
+	"errors"
+	"net"
+)
+
+// enablePacketInfo is only implemented on Linux
+func enablePacketInfo(*net.UDPConn) error {
+	return errors.ErrUnsupported
+}
+
+// packetDestination is only implemented on Linux
+func packetDestination([]byte) *net.UDPAddr {
+	return nil
+}
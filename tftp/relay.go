@@ -0,0 +1,379 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relay is a Handler serving the files of an upstream server out of a
+// local cache. A cache miss is streamed to the client while it is written
+// to the cache, a cached file is served from disk until it is TTL old and
+// then revalidated with the origin. A cached file is served as it is when
+// the origin cannot be reached.
+// The clients asking for a file while it is fetched share the fetch. The
+// modification time of a cached file is when it was last validated, so
+// the cache stays valid across restarts
+type Relay struct {
+	// Origin is the upstream server, a tftp://host[:port][/prefix] or an
+	// http(s) URL the requested filenames are appended to
+	Origin     string
+	CacheDir   string        // directory the fetched files are stored in
+	TTL        time.Duration // how long a file is served before it is revalidated
+	Client     *Client       // fetches from tftp origins, the zero Client when nil
+	HTTPClient *http.Client  // fetches from http origins, one with a 10 minute timeout when nil
+	// IdleTimeout is how long a fetch may go without data from the origin
+	// before it is abandoned, 30 seconds when zero
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*relayFetch // fetches in progress by filename
+}
+
+// relayFetch is a fetch from the origin into a temporary file, the clients
+// sharing it read the file as it grows
+type relayFetch struct {
+	tmp     string // path of the temporary file
+	mu      sync.Mutex
+	size    int64 // size announced by the origin, -1 when unknown
+	n       int64 // bytes written so far
+	done    bool
+	err     error         // outcome of a done fetch
+	changed chan struct{} // closed on progress and replaced
+}
+
+// errNotModified tells the cached file is still the one the origin has
+var errNotModified = errors.New("tftp: not modified")
+
+// errStarted wraps the errors of fetches that already sent data to clients
+var errStarted = errors.New("tftp: relay failed mid-transfer")
+
+// errStalled ends fetches the origin sent nothing for IdleTimeout
+var errStalled = errors.New("tftp: origin stalled")
+
+// defaultHTTPClient fetches from http origins when HTTPClient is nil
+var defaultHTTPClient = &http.Client{Timeout: 10 * time.Minute}
+
+func (r *Relay) ServeTFTP(w ResponseWriter, req *Request) {
+	// the origin is asked for the name as requested, the cache holds it
+	// under its local form
+	local, ok := localPath(req.Filename)
+	if !ok {
+		w.Error(&fs.PathError{Op: "open", Path: req.Filename, Err: fs.ErrInvalid})
+		return
+	}
+	name := req.Filename
+	cached := filepath.Join(r.CacheDir, local)
+	if info, err := os.Stat(cached); err == nil && time.Since(info.ModTime()) < r.TTL && r.serveCached(w, cached) {
+		return
+	}
+	f, file, err := r.join(name, cached)
+	if err != nil {
+		log.Printf("[%s] caching %s: %v", req.RemoteAddr, name, err)
+		if !r.serveCached(w, cached) {
+			w.Error(err)
+		}
+		return
+	}
+	defer func() { _ = file.Close() }()
+	r.stream(w, req, f, file, cached)
+}
+
+// join returns the fetch of name in progress, starting one unless there
+// is, along with the temporary file it writes to opened for reading
+func (r *Relay) join(name, cached string) (*relayFetch, *os.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.inflight[name]
+	if f == nil {
+		if err := os.MkdirAll(filepath.Dir(cached), 0o755); err != nil {
+			return nil, nil, err
+		}
+		tmp, err := createTemp(cached, 0o644)
+		if err != nil {
+			return nil, nil, err
+		}
+		f = &relayFetch{tmp: tmp.Name(), size: -1, changed: make(chan struct{})}
+		if r.inflight == nil {
+			r.inflight = make(map[string]*relayFetch)
+		}
+		r.inflight[name] = f
+		// the fetch outlives the client that started it, others may be reading
+		go r.run(f, tmp, name, cached)
+	}
+	// the file is opened before run can move it, under r.mu
+	file, err := os.Open(f.tmp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, file, nil
+}
+
+// run fetches name into tmp and moves it into the cache
+func (r *Relay) run(f *relayFetch, tmp *os.File, name, cached string) {
+	// the clients reading the fetch wait as long as it does, a stalled
+	// origin must not hold them and the fetch forever
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	idle := r.IdleTimeout
+	if idle <= 0 {
+		idle = 30 * time.Second
+	}
+	stall := time.AfterFunc(idle, func() { cancel(errStalled) })
+	defer stall.Stop()
+	err := r.fetch(ctx, &fetchWriter{f: f, file: tmp, stall: stall, idle: idle}, name, cached)
+	if cause := context.Cause(ctx); err != nil && cause != nil {
+		err = fmt.Errorf("%w: %w", cause, err)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	r.mu.Lock()
+	switch {
+	case err == nil:
+		if renameErr := os.Rename(f.tmp, cached); renameErr != nil {
+			// the clients got the file, the next one fetches it again
+			log.Printf("caching %s: %v", name, renameErr)
+			_ = os.Remove(f.tmp)
+		}
+	case errors.Is(err, errNotModified):
+		now := time.Now()
+		_ = os.Chtimes(cached, now, now)
+		_ = os.Remove(f.tmp)
+	default:
+		_ = os.Remove(f.tmp)
+	}
+	delete(r.inflight, name)
+	r.mu.Unlock()
+	f.finish(err)
+}
+
+// stream sends the file of f to the client as it arrives
+func (r *Relay) stream(w ResponseWriter, req *Request, f *relayFetch, file *os.File, cached string) {
+	ctx := req.Context()
+	n, done, err := f.wait(ctx, 0)
+	if ctx.Err() != nil {
+		w.Error(context.Cause(ctx))
+		return
+	}
+	if n == 0 && done {
+		switch {
+		case err == nil:
+			// an empty file
+		case errors.Is(err, errNotModified):
+			if !r.serveCached(w, cached) {
+				w.Error(fmt.Errorf("tftp: cached %s is gone", req.Filename))
+			}
+		case errors.Is(err, fs.ErrNotExist):
+			w.Error(err)
+		default:
+			// an unreachable origin leaves us with what we have
+			log.Printf("[%s] origin: %v", req.RemoteAddr, err)
+			if !r.serveCached(w, cached) {
+				w.Error(err)
+			}
+		}
+		return
+	}
+	// the origin announced the size before the first byte
+	f.mu.Lock()
+	size := f.size
+	f.mu.Unlock()
+	if size >= 0 {
+		w.SetSize(size)
+	}
+	buf := make([]byte, 32*1024)
+	var off int64
+	for {
+		for off < n {
+			k, err := file.ReadAt(buf[:min(int64(len(buf)), n-off)], off)
+			if k > 0 {
+				if _, err := w.Write(buf[:k]); err != nil {
+					return
+				}
+				off += int64(k)
+			} else if err != nil {
+				w.Error(err)
+				return
+			}
+		}
+		if done {
+			if err != nil {
+				// the client already received part of the file, the cached copy cannot follow it
+				w.Error(fmt.Errorf("%w: %w", errStarted, err))
+			}
+			return
+		}
+		n, done, err = f.wait(ctx, off)
+		if ctx.Err() != nil {
+			w.Error(context.Cause(ctx))
+			return
+		}
+	}
+}
+
+// serveCached sends the cached file, it reports false when there is none
+func (r *Relay) serveCached(w ResponseWriter, cached string) bool {
+	f, err := os.Open(cached)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	serveContent(w, f, info.Size())
+	return true
+}
+
+// fetch writes name from the origin to w
+func (r *Relay) fetch(ctx context.Context, w *fetchWriter, name, cached string) error {
+	origin, err := url.Parse(r.Origin)
+	if err != nil {
+		return err
+	}
+	switch origin.Scheme {
+	case "tftp":
+		return r.fetchTFTP(ctx, origin, name, w)
+	case "http", "https":
+		return r.fetchHTTP(ctx, origin, name, cached, w)
+	}
+	return fmt.Errorf("tftp: unsupported origin %s", r.Origin)
+}
+
+func (r *Relay) fetchTFTP(ctx context.Context, origin *url.URL, name string, w io.Writer) error {
+	host := origin.Host
+	if origin.Port() == "" {
+		host = net.JoinHostPort(origin.Hostname(), "69")
+	}
+	c := r.Client
+	if c == nil {
+		c = new(Client)
+	}
+	_, err := c.Get(ctx, host, strings.TrimPrefix(path.Join(origin.Path, name), "/"), w)
+	var remote *RemoteError
+	if errors.As(err, &remote) && remote.Code == ErrNotFound {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// fetchHTTP fetches name unless the cached file is still current. The
+// modification time of the cached file is when it was last validated
+func (r *Relay) fetchHTTP(ctx context.Context, origin *url.URL, name, cached string, w *fetchWriter) error {
+	u := origin.JoinPath(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(cached)
+	if err != nil {
+		info = nil
+	} else {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	client := r.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if info == nil {
+			return fmt.Errorf("tftp: unexpected %s from %s", resp.Status, u.Redacted())
+		}
+		return errNotModified
+	case http.StatusNotFound, http.StatusGone:
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	default:
+		return fmt.Errorf("tftp: %s from %s", resp.Status, u.Redacted())
+	}
+	// origins ignoring conditional requests still tell an unchanged file
+	// by its modification time and size
+	if info != nil && resp.ContentLength == info.Size() {
+		modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err == nil && !modified.After(info.ModTime()) {
+			return errNotModified
+		}
+	}
+	if resp.ContentLength >= 0 {
+		w.f.setSize(resp.ContentLength)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// fetchWriter writes to the temporary file of a fetch and wakes its readers.
+// Every write puts off abandoning the fetch by idle
+type fetchWriter struct {
+	f     *relayFetch
+	file  *os.File
+	stall *time.Timer
+	idle  time.Duration
+}
+
+func (w *fetchWriter) Write(p []byte) (int, error) {
+	w.stall.Reset(w.idle)
+	n, err := w.file.Write(p)
+	w.f.mu.Lock()
+	w.f.n += int64(n)
+	w.f.notify()
+	w.f.mu.Unlock()
+	return n, err
+}
+
+// notify wakes the readers waiting for progress, f.mu must be held
+func (f *relayFetch) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *relayFetch) setSize(size int64) {
+	f.mu.Lock()
+	f.size = size
+	f.mu.Unlock()
+}
+
+func (f *relayFetch) finish(err error) {
+	f.mu.Lock()
+	f.done, f.err = true, err
+	f.notify()
+	f.mu.Unlock()
+}
+
+// wait returns the bytes written so far once there are more than off or
+// the fetch is done, along with the outcome of a done fetch
+func (f *relayFetch) wait(ctx context.Context, off int64) (n int64, done bool, err error) {
+	for {
+		f.mu.Lock()
+		n, done, err = f.n, f.done, f.err
+		changed := f.changed
+		f.mu.Unlock()
+		if n > off || done {
+			return n, done, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return n, done, context.Cause(ctx)
+		}
+	}
+}
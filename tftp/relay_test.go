@@ -0,0 +1,290 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestRelayHTTP(t *testing.T) {
+	payload := bytes.Repeat([]byte("kernel image\n"), 500)
+	modified := time.Now().Add(-time.Hour)
+	var hits, fetches atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path != "/boot/vmlinuz" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-Modified-Since") == "" {
+			fetches.Add(1)
+		}
+		http.ServeContent(w, r, "vmlinuz", modified, bytes.NewReader(payload))
+	}))
+	dir := t.TempDir()
+	relay := &Relay{Origin: origin.URL + "/boot", CacheDir: dir, TTL: 500 * time.Millisecond}
+	addr := serve(t, &Server{Handler: relay})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+	get := func(name string) ([]byte, error) {
+		var buf bytes.Buffer
+		_, err := c.Get(ctx, addr, name, &buf)
+		return buf.Bytes(), err
+	}
+
+	// a miss is fetched and cached, a hit is served from disk
+	for range 2 {
+		b, err := get("vmlinuz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, payload) {
+			t.Fatalf("received %d bytes; expected %d", len(b), len(payload))
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected 1 origin request; actual %d", n)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "vmlinuz")); !bytes.Equal(b, payload) {
+		t.Errorf("cached %d bytes; expected %d", len(b), len(payload))
+	}
+
+	// an expired file is revalidated instead of fetched again
+	time.Sleep(relay.TTL)
+	if b, err := get("vmlinuz"); err != nil || !bytes.Equal(b, payload) {
+		t.Fatalf("revalidated %d bytes: %v", len(b), err)
+	}
+	if h, f := hits.Load(), fetches.Load(); h != 2 || f != 1 {
+		t.Errorf("expected 2 origin requests and 1 fetch; actual %d and %d", h, f)
+	}
+
+	// names leaving the cache are refused before the origin is asked
+	for _, name := range []string{"../vmlinuz", "..\\vmlinuz"} {
+		_, err := get(name)
+		var remote *RemoteError
+		if !errors.As(err, &remote) || remote.Code != ErrAccessViolation {
+			t.Errorf("%s: expected %v; actual %v", name, ErrAccessViolation, err)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("expected 2 origin requests; actual %d", n)
+	}
+
+	// files missing upstream are missing here
+	_, err := get("initrd")
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != ErrNotFound {
+		t.Errorf("expected %v; actual %v", ErrNotFound, err)
+	}
+
+	// the cached copy outlives the origin
+	origin.Close()
+	time.Sleep(relay.TTL)
+	if b, err := get("vmlinuz"); err != nil || !bytes.Equal(b, payload) {
+		t.Fatalf("served %d stale bytes: %v", len(b), err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the cached file to be left; actual %d files", len(entries))
+	}
+}
+
+func TestRelayTFTP(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, 3*BlockSize+100)
+	var hits atomic.Int32
+	origin := serve(t, &Server{
+		FS:              fstest.MapFS{"pxe/boot.img": {Data: payload}},
+		OnTransferStart: func(TransferStats) { hits.Add(1) },
+	})
+	dir := t.TempDir()
+	addr := serve(t, &Server{Handler: &Relay{Origin: "tftp://" + origin + "/pxe", CacheDir: dir, TTL: time.Hour}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+
+	for range 2 {
+		var buf bytes.Buffer
+		if _, err := c.Get(ctx, addr, "boot.img", &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), payload) {
+			t.Fatalf("received %d bytes; expected %d", buf.Len(), len(payload))
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected 1 origin transfer; actual %d", n)
+	}
+
+	_, err := c.Get(ctx, addr, "missing", new(bytes.Buffer))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != ErrNotFound {
+		t.Errorf("expected %v; actual %v", ErrNotFound, err)
+	}
+}
+
+func TestRelayCoalesce(t *testing.T) {
+	payload := bytes.Repeat([]byte("initrd\n"), 2000)
+	release := make(chan struct{})
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		// the first blocks reach every client before the rest is released
+		_, _ = w.Write(payload[:4*BlockSize])
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write(payload[4*BlockSize:])
+	}))
+	defer origin.Close()
+	s := &Server{Handler: &Relay{Origin: origin.URL, CacheDir: t.TempDir(), TTL: time.Hour}}
+	addr := serve(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const clients = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var c Client
+			var buf bytes.Buffer
+			_, err := c.Get(ctx, addr, "initrd", &buf)
+			if err == nil && !bytes.Equal(buf.Bytes(), payload) {
+				err = fmt.Errorf("received %d bytes; expected %d", buf.Len(), len(payload))
+			}
+			errs <- err
+		}()
+	}
+	// every client is reading the fetch once it has a block acknowledged
+	for started := 0; started < clients; {
+		if ctx.Err() != nil {
+			t.Fatal("clients did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+		started = 0
+		for _, ss := range s.Sessions() {
+			if ss.Blocks > 0 {
+				started++
+			}
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected 1 origin request; actual %d", n)
+	}
+}
+
+func TestRelayRestart(t *testing.T) {
+	payload := bytes.Repeat([]byte("pxelinux\n"), 300)
+	modified := time.Now().Add(-time.Hour)
+	var hits, fetches atomic.Int32
+	var ignoreConditional atomic.Bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if ignoreConditional.Load() {
+			// same size and modification time, different bytes to tell them apart
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+			_, _ = w.Write(bytes.ToUpper(payload))
+			return
+		}
+		if r.Header.Get("If-Modified-Since") == "" {
+			fetches.Add(1)
+		}
+		http.ServeContent(w, r, "pxelinux.0", modified, bytes.NewReader(payload))
+	}))
+	defer origin.Close()
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	get := func(ttl time.Duration) {
+		t.Helper()
+		addr := serve(t, &Server{Handler: &Relay{Origin: origin.URL, CacheDir: dir, TTL: ttl}})
+		var c Client
+		var buf bytes.Buffer
+		if _, err := c.Get(ctx, addr, "pxelinux.0", &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), payload) {
+			t.Fatalf("received %q...; expected %q...", buf.Bytes()[:8], payload[:8])
+		}
+	}
+
+	get(time.Hour)
+	// a new relay over the same cache serves fresh files from disk
+	get(time.Hour)
+	if h := hits.Load(); h != 1 {
+		t.Errorf("expected 1 origin request; actual %d", h)
+	}
+	// and revalidates expired ones by their modification time
+	get(0)
+	if h, f := hits.Load(), fetches.Load(); h != 2 || f != 1 {
+		t.Errorf("expected 2 origin requests and 1 fetch; actual %d and %d", h, f)
+	}
+	// or by their size when the origin ignores conditional requests
+	ignoreConditional.Store(true)
+	get(0)
+	if h := hits.Load(); h != 3 {
+		t.Errorf("expected 3 origin requests; actual %d", h)
+	}
+}
+
+func TestRelayStall(t *testing.T) {
+	payload := bytes.Repeat([]byte("rootfs\n"), 2000)
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		// the origin stops sending after the first blocks
+		_, _ = w.Write(payload[:4*BlockSize])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer origin.Close()
+	relay := &Relay{Origin: origin.URL, CacheDir: t.TempDir(), TTL: time.Hour, IdleTimeout: 100 * time.Millisecond}
+	addr := serve(t, &Server{Handler: relay})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+
+	// the stalled fetch is abandoned and fails its client, the next
+	// request fetches the file again instead of joining it
+	for i := int32(1); i <= 2; i++ {
+		start := time.Now()
+		_, err := c.Get(ctx, addr, "rootfs", new(bytes.Buffer))
+		var remote *RemoteError
+		if !errors.As(err, &remote) {
+			t.Fatalf("expected a remote error; actual %v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("the client waited %v for a stalled origin", d)
+		}
+		if n := hits.Load(); n != i {
+			t.Errorf("expected %d origin requests; actual %d", i, n)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package tftp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ErrRemapDenied is returned by Remap.Apply when an "a" rule matches
+var ErrRemapDenied = errors.New("tftp: filename denied by remap rule")
+
+// Remap rewrites requested filenames before they are looked up, in the
+// style of the remap file of tftp-hpa. Every line holds a rule:
+//
+//	flags regex [replacement]
+//
+// Rules are applied in order to the result of the rules before them.
+// Lines starting with # are comments. The flags are
+//
+//	r  replace the match with the replacement
+//	g  replace every match instead of the first one
+//	i  match case insensitively
+//	e  end rule processing when the rule matched
+//	s  start over with the first rule when the rule matched
+//	a  deny the request when the rule matched
+//	G  only apply the rule to read requests
+//	P  only apply the rule to write requests
+//
+// The replacement may refer to \0 for the whole match, \1 to \9 for the
+// groups of the regex, \i for the client IP address and \x for the client
+// IPv4 address in hex the way PXE clients name their config files
+type Remap struct {
+	rules []remapRule
+}
+
+type remapRule struct {
+	re          *regexp.Regexp
+	replacement []remapPart
+	replace     bool
+	global      bool
+	end         bool
+	restart     bool
+	deny        bool
+	op          OpCode // the only request type the rule applies to, zero for both
+}
+
+// remapPart is a piece of a replacement, either literal text or a reference
+type remapPart struct {
+	text  string
+	group int  // the group referenced, -1 for text and client references
+	ref   byte // 'i' or 'x' for client references
+}
+
+// maxRemapRestarts bounds "s" rules that keep matching their own output
+const maxRemapRestarts = 100
+
+// LoadRemap reads the remap rules in the file name
+func LoadRemap(name string) (*Remap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return ParseRemap(f)
+}
+
+// ParseRemap reads remap rules from r
+func ParseRemap(r io.Reader) (*Remap, error) {
+	m := new(Remap)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		rule, err := parseRemapRule(strings.Fields(text))
+		if err != nil {
+			return nil, fmt.Errorf("remap line %d: %w", line, err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseRemapRule(fields []string) (remapRule, error) {
+	var rule remapRule
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, errors.New("expected flags, regex and an optional replacement")
+	}
+	expr := fields[1]
+	for _, flag := range fields[0] {
+		switch flag {
+		case 'r':
+			rule.replace = true
+		case 'g':
+			rule.global = true
+		case 'i':
+			expr = "(?i)" + expr
+		case 'e':
+			rule.end = true
+		case 's':
+			rule.restart = true
+		case 'a':
+			rule.deny = true
+		case 'G':
+			rule.op = OpRRQ
+		case 'P':
+			rule.op = OpWRQ
+		default:
+			return rule, fmt.Errorf("unknown flag %q", flag)
+		}
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return rule, err
+	}
+	rule.re = re
+	if len(fields) == 3 {
+		rule.replacement, err = parseReplacement(fields[2], re.NumSubexp())
+		if err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+// parseReplacement splits a replacement into literal text and references
+func parseReplacement(s string, groups int) ([]remapPart, error) {
+	var (
+		parts []remapPart
+		text  strings.Builder
+	)
+	flush := func() {
+		if text.Len() > 0 {
+			parts = append(parts, remapPart{text: text.String(), group: -1})
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			text.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, errors.New("trailing backslash in replacement")
+		}
+		switch c := s[i]; {
+		case c >= '0' && c <= '9':
+			if int(c-'0') > groups {
+				return nil, fmt.Errorf("replacement refers to missing group \\%c", c)
+			}
+			flush()
+			parts = append(parts, remapPart{group: int(c - '0')})
+		case c == 'i' || c == 'x':
+			flush()
+			parts = append(parts, remapPart{group: -1, ref: c})
+		default:
+			// any other escaped character stands for itself
+			text.WriteByte(c)
+		}
+	}
+	flush()
+	return parts, nil
+}
+
+// Apply returns the filename requested by client with op after the rules
+// were applied. It returns ErrRemapDenied when a rule denies the request
+func (m *Remap) Apply(filename string, client net.IP, op OpCode) (string, error) {
+	restarts := 0
+RESTART:
+	for _, rule := range m.rules {
+		if rule.op != 0 && rule.op != op {
+			continue
+		}
+		matches := rule.re.FindAllStringSubmatchIndex(filename, 1)
+		if rule.global {
+			matches = rule.re.FindAllStringSubmatchIndex(filename, -1)
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		if rule.deny {
+			return filename, ErrRemapDenied
+		}
+		if rule.replace {
+			filename = rule.expand(filename, matches, client)
+		}
+		if rule.end {
+			break
+		}
+		if rule.restart {
+			if restarts++; restarts > maxRemapRestarts {
+				return filename, errors.New("tftp: remap rules restart too often")
+			}
+			goto RESTART
+		}
+	}
+	return filename, nil
+}
+
+// expand replaces the matches in s with the replacement of the rule
+func (rule remapRule) expand(s string, matches [][]int, client net.IP) string {
+	var b strings.Builder
+	last := 0
+	for _, match := range matches {
+		b.WriteString(s[last:match[0]])
+		for _, part := range rule.replacement {
+			switch {
+			case part.ref == 'i':
+				b.WriteString(client.String())
+			case part.ref == 'x':
+				if ip4 := client.To4(); ip4 != nil {
+					fmt.Fprintf(&b, "%02X%02X%02X%02X", ip4[0], ip4[1], ip4[2], ip4[3])
+				}
+			case part.group >= 0:
+				if start := match[2*part.group]; start >= 0 {
+					b.WriteString(s[start:match[2*part.group+1]])
+				}
+			default:
+				b.WriteString(part.text)
+			}
+		}
+		last = match[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// remap applies the remap rules of the server to a requested filename
+func (s *Server) remap(filename string, addr net.Addr, op OpCode) (string, error) {
+	if s.Remap == nil {
+		return filename, nil
+	}
+	var ip net.IP
+	if a, ok := addr.(*net.UDPAddr); ok {
+		ip = a.IP
+	}
+	return s.Remap.Apply(filename, ip, op)
+}
@@ -0,0 +1,121 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const testRemap = `
+# windows clients use backslashes
+rg  \\                  /
+# strip the tftp root some clients prefix
+r   ^/tftpboot/
+ri  ^PXELINUX\.0$       pxelinux.0
+# per client config files
+rG  ^pxelinux\.cfg/default$  pxelinux.cfg/\x
+re  ^boot/(.*)\.efi$    efi/\1/\i
+r   ^efi/               never/
+a   ^secret
+rP  ^(.*)$              uploads/\0
+`
+
+func TestRemap(t *testing.T) {
+	m, err := ParseRemap(strings.NewReader(testRemap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := net.ParseIP("192.0.2.10")
+
+	tests := []struct {
+		filename string
+		op       OpCode
+		expected string
+		err      error
+	}{
+		{"pxelinux.0", OpRRQ, "pxelinux.0", nil},
+		{`boot\x86\kernel`, OpRRQ, "boot/x86/kernel", nil},
+		{"/tftpboot/PXELinux.0", OpRRQ, "pxelinux.0", nil},
+		{"pxelinux.cfg/default", OpRRQ, "pxelinux.cfg/C000020A", nil},
+		{"boot/grub.efi", OpRRQ, "efi/grub/192.0.2.10", nil},
+		{"secret/key", OpRRQ, "secret/key", ErrRemapDenied},
+		{"pxelinux.cfg/default", OpWRQ, "uploads/pxelinux.cfg/default", nil},
+	}
+	for _, test := range tests {
+		actual, err := m.Apply(test.filename, client, test.op)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v; actual %v", test.filename, test.err, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s: expected %q; actual %q", test.filename, test.expected, actual)
+		}
+	}
+}
+
+func TestRemapRestart(t *testing.T) {
+	m, err := ParseRemap(strings.NewReader("rs ^a(.*) \\1\nr ^b c\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := m.Apply("aaab", nil, OpRRQ)
+	if err != nil || actual != "c" {
+		t.Errorf("expected %q; actual %q, %v", "c", actual, err)
+	}
+	m, err = ParseRemap(strings.NewReader("rs x xx\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Apply("x", nil, OpRRQ); err == nil {
+		t.Error("expected endless restarts to fail")
+	}
+}
+
+func TestParseRemapErrors(t *testing.T) {
+	for _, rules := range []string{
+		"r",
+		"q ^a b",
+		"r ( b",
+		`r ^a \1`,
+		`r ^a b\`,
+		"r ^a b c",
+	} {
+		if _, err := ParseRemap(strings.NewReader(rules)); err == nil {
+			t.Errorf("expected an error parsing %q", rules)
+		}
+	}
+}
+
+func TestServerRemap(t *testing.T) {
+	m, err := ParseRemap(strings.NewReader("r ^/tftpboot/\na ^secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"pxelinux.0": {Data: []byte("loader")},
+		"secret":     {Data: []byte("key")},
+	}
+	addr := serve(t, &Server{FS: fsys, Remap: m})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+	buf := new(bytes.Buffer)
+	_, err = c.Get(ctx, addr, "/tftpboot/pxelinux.0", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "loader" {
+		t.Errorf("received %q", buf.String())
+	}
+	var remote *RemoteError
+	_, err = c.Get(ctx, addr, "secret", new(bytes.Buffer))
+	if !errors.As(err, &remote) || remote.Code != ErrAccessViolation {
+		t.Errorf("expected an access violation; actual %v", err)
+	}
+}
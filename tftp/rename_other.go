@@ -0,0 +1,9 @@
+//go:build !linux
+
+package tftp
+
+// renameNoReplace moves oldpath to newpath unless newpath exists.
+// Only Linux renames atomically without replacing
+func renameNoReplace(oldpath, newpath string) error {
+	return checkedRename(oldpath, newpath)
+}
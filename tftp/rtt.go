@@ -0,0 +1,61 @@
+package tftp
+
+import "time"
+
+// rtt estimates the round-trip time to a client and derives the
+// retransmission timeout from it the way TCP does (Jacobson/Karels, RFC 6298).
+// A fixed estimator keeps the timeout it was created with
+type rtt struct {
+	srtt    time.Duration // smoothed round-trip time
+	rttvar  time.Duration // round-trip time variation
+	rto     time.Duration // current retransmission timeout
+	min     time.Duration // bounds of the retransmission timeout
+	max     time.Duration
+	sampled bool // at least one round trip was measured
+	fixed   bool
+}
+
+// newRTT returns an estimator starting with the initial timeout
+func newRTT(initial, min, max time.Duration, fixed bool) *rtt {
+	return &rtt{rto: initial, min: min, max: max, fixed: fixed}
+}
+
+// newRTT returns the round-trip time estimator of a transfer
+func (s *Server) newRTT(opts transferOpts) *rtt {
+	return newRTT(opts.timeout, s.MinTimeout, s.MaxTimeout, opts.fixed)
+}
+
+// sample adds a round trip measured on a packet that was sent only once.
+// Samples of retransmitted packets are ambiguous and must be left out (Karn's algorithm)
+func (r *rtt) sample(d time.Duration) {
+	if !r.sampled {
+		r.srtt, r.rttvar, r.sampled = d, d/2, true
+	} else {
+		delta := r.srtt - d
+		if delta < 0 {
+			delta = -delta
+		}
+		r.rttvar = (3*r.rttvar + delta) / 4
+		r.srtt = (7*r.srtt + d) / 8
+	}
+	if !r.fixed {
+		r.rto = min(max(r.srtt+4*r.rttvar, r.min), r.max)
+	}
+}
+
+// backoff doubles the timeout after waiting for a reply timed out
+func (r *rtt) backoff() {
+	if !r.fixed {
+		r.rto = min(2*r.rto, r.max)
+	}
+}
+
+// timeout returns the current retransmission timeout
+func (r *rtt) timeout() time.Duration {
+	return r.rto
+}
+
+// estimate returns the smoothed round-trip time, zero until a round trip was measured
+func (r *rtt) estimate() time.Duration {
+	return r.srtt
+}
@@ -0,0 +1,59 @@
+package tftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTT(t *testing.T) {
+	r := newRTT(time.Second, 10*time.Millisecond, 8*time.Second, false)
+	if actual := r.timeout(); actual != time.Second {
+		t.Errorf("expected the initial timeout; actual %v", actual)
+	}
+
+	// steady round trips shrink the timeout down to the round-trip time
+	for i := 0; i < 50; i++ {
+		r.sample(20 * time.Millisecond)
+	}
+	if actual := r.estimate(); actual != 20*time.Millisecond {
+		t.Errorf("expected rtt 20ms; actual %v", actual)
+	}
+	if actual := r.timeout(); actual < 20*time.Millisecond || actual > 25*time.Millisecond {
+		t.Errorf("expected timeout close to 20ms; actual %v", actual)
+	}
+
+	// the timeout never drops below the lower bound
+	r.sample(time.Microsecond)
+	for i := 0; i < 50; i++ {
+		r.sample(time.Microsecond)
+	}
+	if actual := r.timeout(); actual != 10*time.Millisecond {
+		t.Errorf("expected the lower bound; actual %v", actual)
+	}
+
+	// every timeout doubles the wait up to the upper bound
+	expected := []time.Duration{20, 40, 80, 160, 320, 640, 1280, 2560, 5120, 8000}
+	for _, e := range expected {
+		r.backoff()
+		if actual := r.timeout(); actual != e*time.Millisecond {
+			t.Errorf("expected backoff to %vms; actual %v", e, actual)
+		}
+	}
+
+	// a jittery path keeps a safety margin above the mean
+	r = newRTT(time.Second, time.Millisecond, time.Minute, false)
+	for i := 0; i < 50; i++ {
+		r.sample(time.Duration(10+20*(i%2)) * time.Millisecond)
+	}
+	if actual := r.timeout(); actual < 50*time.Millisecond {
+		t.Errorf("expected a timeout well above the 20ms mean; actual %v", actual)
+	}
+
+	// a negotiated timeout stays fixed
+	r = newRTT(3*time.Second, time.Millisecond, time.Minute, true)
+	r.sample(time.Millisecond)
+	r.backoff()
+	if actual := r.timeout(); actual != 3*time.Second {
+		t.Errorf("expected a fixed timeout; actual %v", actual)
+	}
+}
@@ -1,23 +1,81 @@
 package tftp
 
 import (
-	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"io"
+	"io/fs"
 	"log"
 	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Server struct {
-	Payload []byte        // the payload served for all read requests
-	Retries uint8         // number of retires on failed requests
-	Timeout time.Duration // waiting duration of an achnowledgment
+	Handler       Handler       // handles read requests, FileServer(FS) or PayloadServer(Payload) when nil
+	FS            fs.FS         // file system read requests are resolved against
+	Payload       []byte        // the payload served for all read requests when FS is nil
+	UploadDir     string        // directory write requests are stored in, uploads are disabled when empty
+	MaxUploadSize int64         // largest file accepted from a client in bytes, zero means no limit
+	UploadQuota   int64         // bytes UploadDir may hold, zero means no limit
+	ClientQuota   int64         // bytes one client IP may upload while the server runs, zero means no limit
+	Overwrite     bool          // completed uploads replace existing files instead of being refused
+	MaxWindowSize uint16        // largest windowsize a client may negotiate
+	Rollover      uint16        // block number following 65535, either 0 or 1
+	Remap         *Remap        // rewrites requested filenames before lookup, nil leaves them unchanged
+	Access        []AccessRule  // decide which clients may transfer which files, checked after Remap
+	Retries       uint8         // number of retires on failed requests
+	Timeout       time.Duration // initial waiting duration of an achnowledgment, adapted to the round-trip time
+	MinTimeout    time.Duration // lower bound of the adapted timeout
+	MaxTimeout    time.Duration // upper bound of the adapted timeout, retries back off up to it
+
+	MaxTransfers    int           // transfers in flight at once, zero means no limit
+	QueueTimeout    time.Duration // how long a request over MaxTransfers waits before it is refused
+	RateLimit       int64         // bytes per second of all transfers together, zero means no limit
+	ClientRateLimit int64         // bytes per second of the transfers of one client IP, zero means no limit
+
+	OnTransferStart func(TransferStats) // called from the goroutine of every transfer before it starts
+	OnTransferEnd   func(TransferStats) // called once a transfer ended, Err tells whether it failed
+
+	mu        sync.Mutex
+	listeners map[net.PacketConn]struct{} // connections Serve reads requests from
+	closing   bool                        // Shutdown was called
+	ctx       context.Context             // cancelled with ErrServerClosed to abort the transfers in flight
+	cancel    context.CancelCauseFunc
+	wg        sync.WaitGroup // transfers in flight
+
+	slots       chan struct{}                 // one element per transfer in flight when MaxTransfers is set
+	queued      map[string]struct{}           // clients waiting for a slot
+	rate        *rateLimiter                  // shared by all transfers when RateLimit is set
+	clientRates map[netip.Addr]*clientLimiter // limiters of the clients with transfers in flight
+	files       Handler                       // FileServer(FS) shared by the transfers
+	sessions    map[uint64]*session           // transfers in flight by ID
+	lastID      uint64
+	usageOnce   sync.Once            // measures UploadDir the first time UploadQuota is checked
+	usage       int64                // bytes held by UploadDir, including uploads in flight
+	clientUsage map[netip.Addr]int64 // bytes uploaded by each client
 }
 
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to Shutdown,
+// transfers aborted by Shutdown end with it
+var ErrServerClosed = errors.New("tftp: Server closed")
+
+// errors a transfer ends with
+var (
+	errExhaustedRetries = errors.New("tftp: exhausted retries")
+	errUnexpectedPacket = errors.New("tftp: unexpected packet")
+	errTooLarge         = errors.New("tftp: upload exceeds MaxUploadSize")
+)
+
 // ListenAndServe takes an addr as argument.
 // Start listening to the address in "udp" network
 // then calls Serve() method to handle the serve part
-func (s Server) ListenAndServe(addr string) error {
+func (s *Server) ListenAndServe(addr string) error {
 	conn, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		return err
@@ -32,13 +90,13 @@ func (s Server) ListenAndServe(addr string) error {
 // then checks and sets the retries and timeout to appropriate values.
 // Start listening to the network for connections,
 // reads from a conn into a buffer with Datagram size.
-// Checks the payload and passes the rrq and addr to handle method
+// Passes read requests to the handle method and write requests to the receive method
 func (s *Server) Serve(conn net.PacketConn) error {
 	if conn == nil {
 		return errors.New("nil conn")
 	}
-	if s.Payload == nil {
-		return errors.New("payload is required")
+	if s.Payload == nil && s.FS == nil && s.Handler == nil {
+		return errors.New("payload, FS or Handler is required")
 	}
 	if s.Retries == 0 {
 		s.Retries = 10
@@ -46,91 +104,899 @@ func (s *Server) Serve(conn net.PacketConn) error {
 	if s.Timeout == 0 {
 		s.Timeout = time.Second * 6
 	}
-	var rrq ReadReq
+	if s.MinTimeout == 0 {
+		s.MinTimeout = time.Millisecond * 50
+	}
+	if s.MaxTimeout == 0 {
+		s.MaxTimeout = time.Second * 30
+	}
+	if s.Rollover > 1 {
+		return errors.New("rollover must be 0 or 1")
+	}
+	if s.MaxWindowSize == 0 {
+		s.MaxWindowSize = 64
+	}
 
+	if !s.track(conn) {
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+
+	requests := newRequestReader(conn)
 	for {
-		buf := make([]byte, DatagramSize)
-		_, addr, err := conn.ReadFrom(buf)
+		buf := requestBuffers.Get().(*[]byte)
+		err := s.serveRequest(conn, requests, *buf)
+		requestBuffers.Put(buf)
 		if err != nil {
 			return err
 		}
-		err = rrq.UnmarshalBinary(buf)
+	}
+}
+
+// requestBuffers holds the buffers requests are read into, a request is
+// decoded into strings of its own so its buffer is reused right away
+var requestBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, DatagramSize)
+		return &buf
+	},
+}
+
+// serveRequest reads a request into buf and starts the transfer it asks for.
+// It only fails when conn does
+func (s *Server) serveRequest(conn net.PacketConn, requests *requestReader, buf []byte) error {
+	n, addr, local, err := requests.read(buf)
+	if err != nil {
+		if s.shuttingDown() {
+			return ErrServerClosed
+		}
+		return err
+	}
+	if n < 2 {
+		log.Printf("[%s] bad request: short packet", addr)
+		replyErr(conn, addr, ErrIllegalOp, "malformed packet")
+		return nil
+	}
+	switch OpCode(binary.BigEndian.Uint16(buf)) {
+	case OpRRQ:
+		var rrq ReadReq
+		err = rrq.UnmarshalBinary(buf[:n])
+		if err != nil {
+			log.Printf("[%s] bad request: %v", addr, err)
+			replyErr(conn, addr, ErrIllegalOp, err.Error())
+			return nil
+		}
+		filename, ok := s.authorize(conn, addr, rrq.Filename, OpRRQ)
+		if !ok {
+			return nil
+		}
+		s.start(conn, addr, func(ctx context.Context) { s.handle(ctx, addr, local, rrq, filename) })
+	case OpWRQ:
+		var wrq WriteReq
+		err = wrq.UnmarshalBinary(buf[:n])
 		if err != nil {
 			log.Printf("[%s] bad request: %v", addr, err)
-			continue
+			replyErr(conn, addr, ErrIllegalOp, err.Error())
+			return nil
 		}
-		go s.handle(addr.String(), rrq)
+		filename, ok := s.authorize(conn, addr, wrq.Filename, OpWRQ)
+		if !ok {
+			return nil
+		}
+		s.start(conn, addr, func(ctx context.Context) { s.receive(ctx, addr, local, wrq, filename) })
+	case OpErr:
+		// an error is never answered with another error
+		log.Printf("[%s] bad request: unexpected error packet", addr)
+	default:
+		log.Printf("[%s] bad request: unexpected op code", addr)
+		replyErr(conn, addr, ErrIllegalOp, "unexpected op code")
+	}
+	return nil
+}
+
+// Shutdown stops the server from accepting new requests and waits for the
+// transfers in flight to finish. When ctx is done first the remaining
+// transfers are aborted with an error packet to their clients.
+// Shutdown returns once every transfer goroutine has exited
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.listeners {
+		_ = conn.Close()
+	}
+	cancel := s.cancel
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// abort whatever is still running and wait for it to exit
+	if cancel != nil {
+		cancel(ErrServerClosed)
+	}
+	<-done
+	return err
+}
+
+// track registers conn as a listener, it returns false after Shutdown was called
+func (s *Server) track(conn net.PacketConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.PacketConn]struct{})
+		s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	}
+	if s.slots == nil && s.MaxTransfers > 0 {
+		s.slots = make(chan struct{}, s.MaxTransfers)
+		s.queued = make(map[string]struct{})
+	}
+	s.listeners[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.PacketConn) {
+	s.mu.Lock()
+	delete(s.listeners, conn)
+	s.mu.Unlock()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// start runs a transfer requested by addr on conn in its own goroutine
+// unless the server is shutting down. The transfer waits for a free slot
+// when MaxTransfers are in flight and must give up once ctx is done
+func (s *Server) start(conn net.PacketConn, addr net.Addr, transfer func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return
 	}
+	s.wg.Add(1)
+	go func(ctx context.Context) {
+		defer s.wg.Done()
+		release, ok := s.admit(ctx, conn, addr)
+		if !ok {
+			return
+		}
+		defer release()
+		transfer(ctx)
+	}(s.ctx)
+}
+
+// transfer is the state of a read request shared with send
+type transfer struct {
+	conn   *transferConn
+	client string // client address for log lines
+	opts   transferOpts
+	rtt    *rtt
+	stats  *TransferStats
+	limit  throttle
+	buf    []byte // receives the client's acknowledgments
+	// session reports the progress to the admin API
+	session *session
 }
 
-func (s *Server) handle(clientAddr string, rrq ReadReq) {
+// handle answers a read request from addr sent to the local address
+func (s *Server) handle(ctx context.Context, addr net.Addr, local *net.UDPAddr, rrq ReadReq, filename string) {
+	clientAddr := addr.String()
 	log.Printf("[%s] requested file %s", clientAddr, rrq.Filename)
+	stats := s.begin(addr, filename, Download)
+	defer s.end(stats)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	session := s.register(stats, cancel)
+	defer s.unregister(session)
 	// connect to the address in udp network
-	conn, err := net.Dial("udp", clientAddr)
+	conn, err := dial(ctx, local, clientAddr)
 	if err != nil {
 		log.Printf("[%s] dial %v", clientAddr, err)
+		stats.Err = err
 		return
 	}
 	// defer connection closing
 	defer func() { _ = conn.Close() }()
+	limit, release := s.throttle(addr)
+	defer release()
+
+	w := &response{
+		s:        s,
+		t:        &transfer{conn: conn, client: clientAddr, stats: stats, limit: limit, session: session, buf: make([]byte, DatagramSize)},
+		options:  rrq.Options,
+		size:     -1,
+		netascii: strings.EqualFold(rrq.Mode, ModeNetASCII),
+	}
+	req := &Request{Filename: filename, Mode: rrq.Mode, Options: rrq.Options, RemoteAddr: addr, ctx: ctx}
+	s.handler().ServeTFTP(w, req)
+	if w.finish() {
+		log.Printf("[%s] sent %d blocks (rtt %v)", clientAddr, stats.Blocks, stats.RTT)
+	}
+}
 
-	// initiating objects we will need
+// response is the ResponseWriter of a read request. Written data is cut
+// into blocks and sent a window at a time, options are negotiated on the
+// first write so handlers can announce the size of the file before it
+type response struct {
+	s        *Server
+	t        *transfer
+	options  map[string]string // options requested by the client
+	size     int64             // size announced by the handler, -1 when unknown
+	netascii bool
+	started  bool  // options were negotiated
+	err      error // the transfer failed, nothing is sent anymore
+
+	window [][]byte // packets in flight, oldest first
+	free   [][]byte // packet buffers ready for reuse
+	chunk  []byte   // the block being filled
+	first  uint16   // the oldest block in the window
+	block  uint16   // the last block added to the window
+	buf    []byte   // netascii encoding buffer
+}
+
+func (w *response) SetSize(size int64) {
+	if !w.started {
+		w.size = size
+	}
+}
+
+func (w *response) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.started && !w.start() {
+		return 0, w.err
+	}
+	n := len(p)
+	if w.netascii {
+		w.buf = appendNetASCII(w.buf[:0], p)
+		p = w.buf
+	}
+	for len(p) > 0 {
+		k := copy(w.chunk[len(w.chunk):cap(w.chunk)], p)
+		w.chunk, p = w.chunk[:len(w.chunk)+k], p[k:]
+		// a full block goes out, the block that ends the transfer is
+		// only sent by finish since it may have to be an empty one
+		if len(w.chunk) == cap(w.chunk) {
+			if !w.push() {
+				return 0, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *response) Error(err error) {
+	if w.err != nil {
+		return
+	}
+	w.err = err
+	w.t.stats.Err = err
+	log.Printf("[%s] %v", w.t.client, err)
+	switch {
+	case errors.Is(err, fs.ErrInvalid), errors.Is(err, fs.ErrPermission):
+		sendErr(w.t.conn, ErrAccessViolation, "access violation")
+	case errors.Is(err, fs.ErrNotExist):
+		sendErr(w.t.conn, ErrNotFound, "file not found")
+	default:
+		sendErr(w.t.conn, ErrUnknown, "cannot read file")
+	}
+}
+
+// start negotiates the options and prepares the window
+func (w *response) start() bool {
+	w.started = true
+	// netascii changes the size of the file so we cannot announce it
+	size := w.size
+	if w.netascii {
+		size = -1
+	}
+	oack, opts := w.s.negotiate(OpRRQ, w.options, size)
+	w.t.session.size.Store(size)
+	w.t.opts, w.t.rtt = opts, w.s.newRTT(opts)
+	// the client acknowledges the options with block 0 before we send any data
+	if len(oack) > 0 {
+		w.t.stats.Options = oack
+		pkt, err := oack.MarshalBinary()
+		if err != nil {
+			log.Printf("[%s] preparing --oack packet: %v", w.t.client, err)
+			w.err, w.t.stats.Err = err, err
+			return false
+		}
+		if w.s.send(w.t, [][]byte{pkt}, 0) == 0 {
+			w.err = w.t.stats.Err
+			return false
+		}
+	}
+	w.window = make([][]byte, 0, opts.windowSize)
+	w.free = make([][]byte, 0, opts.windowSize)
+	for i := 0; i < opts.windowSize; i++ {
+		w.free = append(w.free, make([]byte, 0, 4+opts.blockSize))
+	}
+	w.chunk = make([]byte, 0, opts.blockSize)
+	w.first = opts.next(0)
+	return true
+}
+
+// push adds the current block to the window and sends the window once it is full
+func (w *response) push() bool {
+	opts := w.t.opts
+	w.block = opts.next(w.block)
+	// preparing the packet before sending it
+	pkt := AppendData(w.free[len(w.free)-1][:0], w.block, w.chunk)
+	w.free = w.free[:len(w.free)-1]
+	w.window = append(w.window, pkt)
+	w.chunk = w.chunk[:0]
+	for len(w.window) == opts.windowSize {
+		if !w.flush() {
+			return false
+		}
+	}
+	return true
+}
+
+// flush sends the window and slides it past the acknowledged blocks
+func (w *response) flush() bool {
+	acked := w.s.send(w.t, w.window, w.first)
+	if acked == 0 {
+		// the client is gone or told us to stop
+		w.err = w.t.stats.Err
+		if w.err == nil {
+			w.err = errExhaustedRetries
+		}
+		return false
+	}
+	for _, pkt := range w.window[:acked] {
+		w.first = w.t.opts.next(w.first)
+		w.t.stats.Blocks++
+		w.t.stats.Bytes += int64(len(pkt) - 4)
+		w.t.session.progress(len(pkt) - 4)
+	}
+	w.free = append(w.free, w.window[:acked]...)
+	w.window = append(w.window[:0], w.window[acked:]...)
+	return true
+}
+
+// finish sends the short block that ends the transfer and waits until
+// every block was acknowledged. It reports whether the transfer succeeded
+func (w *response) finish() bool {
+	if w.err != nil {
+		return false
+	}
+	if !w.started && !w.start() {
+		return false
+	}
+	w.block = w.t.opts.next(w.block)
+	pkt := AppendData(w.free[len(w.free)-1][:0], w.block, w.chunk)
+	w.free = w.free[:len(w.free)-1]
+	w.window = append(w.window, pkt)
+	// loop until the short block was acknowledged
+	for len(w.window) > 0 {
+		if !w.flush() {
+			return false
+		}
+	}
+	return true
+}
+
+// send writes pkts, the packets of consecutive blocks starting with first,
+// to the client and waits for an acknowledgment of one of them.
+// The whole window is retransmitted every time we time out waiting,
+// each time waiting twice as long as before.
+// It returns how many packets the client acknowledged, zero means the
+// transfer failed and t.stats.Err tells why
+func (s *Server) send(t *transfer, pkts [][]byte, first uint16) int {
 	var (
-		ackPkt  Ack
-		errPkt  ErrReq
-		dataPkt = Data{Payload: bytes.NewReader(s.Payload)}
-		buf     = make([]byte, DatagramSize)
+		conn       = t.conn
+		clientAddr = t.client
+		rtt        = t.rtt
+		ackPkt     Ack
+		errPkt     ErrReq
+		buf        = t.buf
 	)
 	// a label for continue to label since we are doing nested loops
-NEXTPACKET:
-	// loop until n != datagramsize
-	// we keep sending bytes from the file/data until we send less than 516
-	// then this will be false
-	for n := DatagramSize; n == DatagramSize; {
-		// preparing the packet before sending it
-		data, err := dataPkt.MarshalBinary()
-		if err != nil {
-			log.Printf("[%s] preparing --data packet: %v", clientAddr, err)
-			return
+RETRY:
+	for i := s.Retries; i > 0; i-- {
+		if i < s.Retries {
+			t.stats.Retransmissions += len(pkts)
 		}
-		// a label for continue to label since we are doing nested loops
-	RETRY:
-		for i := s.Retries; i > 0; i-- {
-			// writing the data from buffer to the connection
-			n, err = conn.Write(data) // send the data packet
+		// the window goes out in one go once the limits allow it,
+		// waiting in between would inflate the round-trip time
+		size := 0
+		for _, pkt := range pkts {
+			size += len(pkt)
+		}
+		if err := t.limit.wait(conn.ctx, size); err != nil {
+			t.stats.Err = err
+			return 0
+		}
+		sent := time.Now()
+		// writing the packets from the window to the connection
+		for _, pkt := range pkts {
+			_, err := conn.Write(pkt) // send the packet
 			if err != nil {
 				log.Printf("[%s] write: %v", clientAddr, err)
-				return
+				t.stats.Err = err
+				return 0
 			}
-			// block until we receive a message
-			_ = conn.SetReadDeadline(time.Now().Add(s.Timeout))
+		}
+		// block until we receive a message, the deadline stays put
+		// while we skip duplicate ACKs
+		_ = conn.SetReadDeadline(time.Now().Add(rtt.timeout()))
+		for {
 			// read the message from the connection to the buffer
-			_, err = conn.Read(buf)
+			n, err := conn.Read(buf)
 			if err != nil {
 				// checking if the err is a timeout error and retry else we log and return
 				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+					rtt.backoff()
 					continue RETRY // goto label
 				}
 				log.Printf("[%s] waiting for ACK: %v", clientAddr, err)
-				return
+				t.stats.Err = err
+				return 0
 			}
 			switch {
 			// checking if the message we received is Acknowledgment message
-			case ackPkt.UnmarshalBinary(buf) == nil:
-				// Check if the block number == the ackpkt
-				if uint16(ackPkt) == dataPkt.Block {
-					continue NEXTPACKET // goto label
+			case ackPkt.UnmarshalBinary(buf[:n]) == nil:
+				// Check if the ackpkt falls within the window
+				if acked := ackedBlocks(first, uint16(ackPkt), len(pkts), t.opts); acked > 0 {
+					// only packets we sent once tell the round-trip time
+					if i == s.Retries {
+						rtt.sample(time.Since(sent))
+						t.stats.RTT = rtt.estimate()
+					}
+					return acked
 				}
+				// a duplicate or stale ACK never triggers a retransmission,
+				// resending on it would double every packet from then on
+				// (the Sorcerer's Apprentice bug, RFC 1123 4.2.3.1)
 			// checking if the ack is an error and return
-			case errPkt.UnmarshalBinary(buf) == nil:
+			case errPkt.UnmarshalBinary(buf[:n]) == nil:
 				log.Printf("[%s] received error: %v", clientAddr, errPkt.Message)
-				return
+				t.stats.Err = &RemoteError{Code: errPkt.Error, Message: errPkt.Message}
+				return 0
 			default:
 				log.Printf("[%s] bad packet", clientAddr)
+				sendErr(conn, ErrIllegalOp, "expected ACK")
+				t.stats.Err = errUnexpectedPacket
+				return 0
+			}
+		}
+	}
+	log.Printf("[%s] exhausted retries", clientAddr)
+	t.stats.Err = errExhaustedRetries
+	return 0
+}
+
+// ackedBlocks returns how many of the n blocks starting with first are
+// acknowledged by an ACK of block, zero when block is outside of the window.
+// Block numbers roll over so we walk the window instead of subtracting
+func ackedBlocks(first, block uint16, n int, opts transferOpts) int {
+	for i := 1; i <= n; i++ {
+		if first == block {
+			return i
+		}
+		first = opts.next(first)
+	}
+	return 0
+}
+
+// receive handles a write request, storing the uploaded file in UploadDir.
+// Every data block is acknowledged before the next one is accepted
+func (s *Server) receive(ctx context.Context, addr net.Addr, local *net.UDPAddr, wrq WriteReq, filename string) {
+	clientAddr := addr.String()
+	log.Printf("[%s] uploading file %s", clientAddr, wrq.Filename)
+	stats := s.begin(addr, filename, Upload)
+	reported := false
+	defer func() {
+		if !reported {
+			s.end(stats)
+		}
+	}()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	session := s.register(stats, cancel)
+	defer s.unregister(session)
+	conn, err := dial(ctx, local, clientAddr)
+	if err != nil {
+		log.Printf("[%s] dial %v", clientAddr, err)
+		stats.Err = err
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	limit, release := s.throttle(addr)
+	defer release()
+
+	if s.UploadDir == "" {
+		sendErr(conn, ErrAccessViolation, "uploads are disabled")
+		stats.Err = errors.New("tftp: uploads are disabled")
+		return
+	}
+	name, ok := localPath(filename)
+	if !ok {
+		sendErr(conn, ErrAccessViolation, "invalid file name")
+		stats.Err = &fs.PathError{Op: "create", Path: filename, Err: fs.ErrInvalid}
+		return
+	}
+	oack, opts := s.negotiate(OpWRQ, wrq.Options, -1)
+	if opts.size > 0 {
+		session.size.Store(opts.size)
+	}
+	rtt := s.newRTT(opts)
+	if len(oack) > 0 {
+		stats.Options = oack
+	}
+	// refuse uploads announced too big before accepting any data
+	if s.MaxUploadSize > 0 && opts.size > s.MaxUploadSize {
+		log.Printf("[%s] upload of %d bytes exceeds the limit", clientAddr, opts.size)
+		sendErr(conn, ErrDiskFull, "file too large")
+		stats.Err = errTooLarge
+		return
+	}
+	if opts.size > 0 && !s.fits(addr, opts.size) {
+		log.Printf("[%s] upload of %d bytes exceeds the quota", clientAddr, opts.size)
+		sendErr(conn, ErrDiskFull, "quota exceeded")
+		stats.Err = errQuotaExceeded
+		return
+	}
+	up, err := createUpload(filepath.Join(s.UploadDir, name), s.Overwrite)
+	if err != nil {
+		log.Printf("[%s] create: %v", clientAddr, err)
+		stats.Err = err
+		switch {
+		case errors.Is(err, fs.ErrExist):
+			sendErr(conn, ErrFileExists, "file already exists")
+		case errors.Is(err, fs.ErrNotExist):
+			sendErr(conn, ErrNotFound, "directory not found")
+		default:
+			sendErr(conn, ErrAccessViolation, "cannot create file")
+		}
+		return
+	}
+	// remove whatever was written if the upload did not complete
+	var (
+		complete  bool
+		committed bool
+		reserved  int64
+	)
+	defer func() {
+		if !committed {
+			up.abort()
+			s.unreserve(addr, reserved)
+		}
+	}()
+
+	var (
+		w   io.Writer = up
+		dec io.WriteCloser
+	)
+	if strings.EqualFold(wrq.Mode, ModeNetASCII) {
+		dec = NewNetASCIIWriter(up)
+		w = dec
+	}
+
+	var (
+		ackPkt Ack // the last block we received
+		errPkt ErrReq
+		buf    = make([]byte, 4+opts.blockSize)
+		ack    = make([]byte, 0, 4)
+	)
+	// writeAck acknowledges the last block we received,
+	// accepted options are acknowledged with an OACK in place of ACK 0
+	writeAck := func() bool {
+		if stats.Blocks == 0 && len(oack) > 0 {
+			ack, err = oack.MarshalBinary()
+		} else {
+			ack, err = AppendAck(ack[:0], uint16(ackPkt)), nil
+		}
+		if err == nil {
+			_, err = conn.Write(ack)
+		}
+		if err != nil {
+			log.Printf("[%s] write ack: %v", clientAddr, err)
+			stats.Err = err
+			return false
+		}
+		return true
+	}
+NEXTPACKET:
+	for !complete {
+	RETRY:
+		for i := s.Retries; i > 0; i-- {
+			if i < s.Retries {
+				stats.Retransmissions++
+			}
+			// (re)send the acknowledgment of the last block and wait for the next window
+			if !writeAck() {
+				return
+			}
+			sent := time.Now()
+			// received counts the blocks of the window, nacked tells whether we
+			// already answered a block out of order with the ack of the last block we have
+			received, nacked := 0, false
+			for {
+				_ = conn.SetReadDeadline(time.Now().Add(rtt.timeout()))
+				n, err := conn.Read(buf)
+				if err != nil {
+					if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+						// part of the window arrived, acknowledge it without using up a retry
+						if received > 0 {
+							continue NEXTPACKET
+						}
+						rtt.backoff()
+						continue RETRY
+					}
+					log.Printf("[%s] waiting for DATA: %v", clientAddr, err)
+					stats.Err = err
+					return
+				}
+				block, payload, dataErr := parseData(buf[:n])
+				switch {
+				case dataErr == nil:
+					// a lost or retransmitted block is answered by acknowledging
+					// the last block we have so the client resends from there
+					if block != opts.next(uint16(ackPkt)) {
+						if !nacked {
+							nacked = true
+							if !writeAck() {
+								return
+							}
+						}
+						continue
+					}
+					if s.MaxUploadSize > 0 && stats.Bytes+int64(n-4) > s.MaxUploadSize {
+						log.Printf("[%s] upload exceeds the limit", clientAddr)
+						sendErr(conn, ErrDiskFull, "file too large")
+						stats.Err = errTooLarge
+						return
+					}
+					if !s.reserve(addr, int64(n-4)) {
+						log.Printf("[%s] upload exceeds the quota", clientAddr)
+						sendErr(conn, ErrDiskFull, "quota exceeded")
+						stats.Err = errQuotaExceeded
+						return
+					}
+					reserved += int64(n - 4)
+					_, err := w.Write(payload)
+					if err != nil {
+						log.Printf("[%s] write file: %v", clientAddr, err)
+						stats.Err = err
+						if errors.Is(err, syscall.ENOSPC) {
+							sendErr(conn, ErrDiskFull, "disk full")
+						} else {
+							sendErr(conn, ErrUnknown, "cannot write file")
+						}
+						return
+					}
+					// the first block answering an ACK we sent once tells the round-trip time
+					if received == 0 && i == s.Retries {
+						rtt.sample(time.Since(sent))
+						stats.RTT = rtt.estimate()
+					}
+					stats.Bytes += int64(n - 4)
+					stats.Blocks++
+					session.progress(n - 4)
+					// holding back the next read slows the client down to the limits
+					if err := limit.wait(ctx, n); err != nil {
+						stats.Err = err
+						return
+					}
+					ackPkt = Ack(block)
+					received++
+					nacked = false
+					// a block shorter than the block size ends the transfer,
+					// otherwise we acknowledge once the whole window arrived
+					complete = n < len(buf)
+					if complete || received == opts.windowSize {
+						continue NEXTPACKET
+					}
+				case errPkt.UnmarshalBinary(buf[:n]) == nil:
+					log.Printf("[%s] received error: %v", clientAddr, errPkt.Message)
+					stats.Err = &RemoteError{Code: errPkt.Error, Message: errPkt.Message}
+					return
+				default:
+					log.Printf("[%s] bad packet", clientAddr)
+					sendErr(conn, ErrIllegalOp, "expected DATA")
+					stats.Err = errUnexpectedPacket
+					return
+				}
 			}
 		}
 		log.Printf("[%s] exhausted retries", clientAddr)
+		stats.Err = errExhaustedRetries
+		return
+	}
+	// flush a CR the decoder held back before we acknowledge the last block
+	if dec != nil {
+		if err = dec.Close(); err != nil {
+			log.Printf("[%s] write file: %v", clientAddr, err)
+			sendErr(conn, ErrUnknown, "cannot write file")
+			stats.Err = err
+			return
+		}
+	}
+	// the file takes its place before the client learns the upload succeeded
+	replaced, err := up.commit(s.Overwrite)
+	if err != nil {
+		log.Printf("[%s] store file: %v", clientAddr, err)
+		stats.Err = err
+		if errors.Is(err, fs.ErrExist) {
+			sendErr(conn, ErrFileExists, "file already exists")
+		} else {
+			sendErr(conn, ErrUnknown, "cannot write file")
+		}
 		return
 	}
-	log.Printf("[%s] sent %d blocks", clientAddr, dataPkt.Block)
+	committed = true
+	s.freed(replaced)
+	stats.Checksum = up.checksum()
+	log.Printf("[%s] received %d blocks (%d bytes, rtt %v)", clientAddr, stats.Blocks, stats.Bytes, stats.RTT)
+	log.Printf("[%s] stored %s sha512/256 %s", clientAddr, name, stats.Checksum)
+	// the upload is complete, lingering for a lost final ACK is not part of it
+	reported = true
+	s.end(stats)
+	s.finish(conn, ackPkt, len(buf), opts.timeout)
+}
+
+// finish sends the final acknowledgment of an upload.
+// We linger for one timeout period so a client that lost the final ack
+// and retransmits its last block gets acknowledged again
+func (s *Server) finish(conn *transferConn, last Ack, size int, timeout time.Duration) {
+	ack, err := last.MarshalBinary()
+	if err != nil {
+		return
+	}
+	var (
+		dataPkt Data
+		buf     = make([]byte, size)
+	)
+	for {
+		_, err = conn.Write(ack)
+		if err != nil {
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if dataPkt.UnmarshalBinary(buf[:n]) != nil || dataPkt.Block != uint16(last) {
+			return
+		}
+	}
+}
+
+// transferConn is the socket of a single transfer, its port is the
+// server's transfer ID. It talks to one client, packets from any other
+// transfer ID are answered with an error without ending the transfer
+type transferConn struct {
+	ctx  context.Context
+	conn *net.UDPConn
+	peer *net.UDPAddr
+	// the address of peer, reading and writing with it does not allocate
+	peerAddr netip.AddrPort
+	stop     func() bool
+}
+
+// dial opens the socket of a transfer with the client, bound to the local
+// address the request arrived on when it is known. Once ctx is done
+// the client is sent an error packet and the socket is closed, which
+// makes the transfer fail on its next read or write
+func dial(ctx context.Context, local *net.UDPAddr, clientAddr string) (*transferConn, error) {
+	peer, err := net.ResolveUDPAddr("udp", clientAddr)
+	if err != nil {
+		return nil, err
+	}
+	// replies leave from the address the request was sent to, a client
+	// drops packets from any other address. nil lets the kernel pick one
+	conn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	c := &transferConn{ctx: ctx, conn: conn, peer: peer}
+	c.peerAddr = unmap(peer.AddrPort())
+	c.stop = context.AfterFunc(ctx, func() {
+		msg := "server shutting down"
+		if errors.Is(context.Cause(ctx), ErrTransferCanceled) {
+			msg = "transfer canceled"
+		}
+		sendErr(c, ErrUnknown, msg)
+		_ = conn.Close()
+	})
+	return c, nil
+}
+
+// Read reads the next packet sent by the client
+func (c *transferConn) Read(p []byte) (int, error) {
+	for {
+		n, addr, err := c.conn.ReadFromUDPAddrPort(p)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return 0, context.Cause(c.ctx)
+			}
+			return 0, err
+		}
+		if addr = unmap(addr); addr == c.peerAddr {
+			return n, nil
+		}
+		log.Printf("[%s] packet from unknown transfer id %s", c.peer, addr)
+		replyErr(c.conn, net.UDPAddrFromAddrPort(addr), ErrUnknownId, "unknown transfer id")
+	}
+}
+
+// unmap turns IPv4-mapped IPv6 addresses into IPv4 ones, a dual-stack
+// socket reports IPv4 peers as mapped addresses
+func unmap(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// Write sends p to the client
+func (c *transferConn) Write(p []byte) (int, error) {
+	n, err := c.conn.WriteToUDPAddrPort(p, c.peerAddr)
+	if err != nil && c.ctx.Err() != nil {
+		return 0, context.Cause(c.ctx)
+	}
+	return n, err
+}
+
+func (c *transferConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *transferConn) Close() error {
+	c.stop()
+	return c.conn.Close()
+}
+
+// sendErr writes an error packet to the client, errors are ignored
+// since the transfer is being aborted anyway
+func sendErr(conn *transferConn, code ErrCode, msg string) {
+	replyErr(conn.conn, conn.peer, code, msg)
+}
+
+// replyErr writes an error packet to addr, errors are ignored
+// since nobody waits for an answer to an error
+func replyErr(conn net.PacketConn, addr net.Addr, code ErrCode, msg string) {
+	b, err := ErrReq{Error: code, Message: msg}.MarshalBinary()
+	if err != nil {
+		return
+	}
+	_, _ = conn.WriteTo(b, addr)
+}
+
+// cleanPath reports whether the client supplied name stays within the
+// served directory. Absolute paths and ".." elements are rejected, so are
+// backslashes, which separate path elements on Windows. Remap rules can
+// turn them into slashes
+func cleanPath(name string) (string, bool) {
+	if !fs.ValidPath(name) || name == "." || strings.Contains(name, `\`) {
+		return "", false
+	}
+	return name, true
+}
+
+// localPath returns the client supplied name as a path relative to a local
+// directory. It reports false for names that would leave the directory on
+// this platform, such as volume names and reserved names on Windows
+func localPath(name string) (string, bool) {
+	name, ok := cleanPath(name)
+	if !ok {
+		return "", false
+	}
+	p := filepath.FromSlash(name)
+	return p, filepath.IsLocal(p)
 }
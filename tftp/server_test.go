@@ -0,0 +1,526 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// startTransfer serves payload and requests it over a raw socket.
+// It returns the client socket, the server's transfer ID and the result of Serve
+func startTransfer(t *testing.T, s *Server) (net.PacketConn, net.Addr, chan error) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(conn) }()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	rrq, err := ReadReq{Filename: "payload", Mode: ModeOctet}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.WriteTo(rrq, conn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data Data
+	buf := make([]byte, DatagramSize)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, tid, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = data.UnmarshalBinary(buf[:n]); err != nil || data.Block != 1 {
+		t.Fatalf("expected block 1; actual %v", err)
+	}
+	return client, tid, served
+}
+
+func TestShutdownWaitsForTransfers(t *testing.T) {
+	s := &Server{Payload: bytes.Repeat([]byte{'x'}, BlockSize+10)}
+	client, tid, served := startTransfer(t, s)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// new requests are no longer served
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed; actual %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned during a transfer: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// finish the transfer
+	buf := make([]byte, DatagramSize)
+	for block := uint16(1); block <= 2; block++ {
+		ack, _ := Ack(block).MarshalBinary()
+		_, err := client.WriteTo(ack, tid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block == 2 {
+			break
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after the transfer finished")
+	}
+}
+
+func TestShutdownAbortsTransfers(t *testing.T) {
+	s := &Server{Payload: bytes.Repeat([]byte{'x'}, BlockSize+10)}
+	client, _, served := startTransfer(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded; actual %v", err)
+	}
+	if err = <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("expected ErrServerClosed; actual %v", err)
+	}
+
+	// the client is told the transfer was aborted
+	var errPkt ErrReq
+	buf := make([]byte, DatagramSize)
+	for {
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("expected an error packet")
+		}
+		if errPkt.UnmarshalBinary(buf[:n]) == nil {
+			break
+		}
+	}
+
+	// a stopped server cannot be started again
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if err = s.Serve(conn); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("expected ErrServerClosed; actual %v", err)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	s := &Server{Payload: []byte("payload")}
+	go func() { _ = s.Serve(conn) }()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	tests := []struct {
+		name string
+		pkt  []byte
+	}{
+		{"short packet", []byte{0}},
+		{"unsupported mode", []byte("\x00\x01file\x00mail\x00")},
+		{"missing mode", []byte("\x00\x01file\x00")},
+		{"unexpected op code", []byte{0, byte(OpAck), 0, 1}},
+		{"unknown op code", []byte{0, 42}},
+	}
+	buf := make([]byte, DatagramSize)
+	for _, test := range tests {
+		_, err = client.WriteTo(test.pkt, conn.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var errPkt ErrReq
+		err = errPkt.UnmarshalBinary(buf[:n])
+		if err != nil || errPkt.Error != ErrIllegalOp {
+			t.Errorf("%s: expected ErrIllegalOp; actual %v %v", test.name, errPkt, err)
+		}
+	}
+}
+
+func TestUnknownTransferID(t *testing.T) {
+	s := &Server{Payload: bytes.Repeat([]byte{'x'}, BlockSize+10)}
+	client, tid, _ := startTransfer(t, s)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+
+	// a packet from another port is answered with an error
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stranger.Close() }()
+	ack, _ := Ack(1).MarshalBinary()
+	_, err = stranger.WriteTo(ack, tid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, DatagramSize)
+	_ = stranger.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := stranger.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errPkt ErrReq
+	if err = errPkt.UnmarshalBinary(buf[:n]); err != nil || errPkt.Error != ErrUnknownId {
+		t.Errorf("expected ErrUnknownId; actual %v %v", errPkt, err)
+	}
+
+	// the transfer with the client goes on
+	_, err = client.WriteTo(ack, tid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data Data
+	for {
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err = client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// block 1 may be retransmitted before our ACK arrives
+		if err = data.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if data.Block == 2 {
+			break
+		}
+	}
+	ack, _ = Ack(2).MarshalBinary()
+	_, _ = client.WriteTo(ack, tid)
+}
+
+func TestTransferHooks(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, 3000)
+	started := make(chan TransferStats, 10)
+	ended := make(chan TransferStats, 10)
+	s := &Server{
+		FS:              fstest.MapFS{"file": {Data: payload}},
+		UploadDir:       t.TempDir(),
+		OnTransferStart: func(stats TransferStats) { started <- stats },
+		OnTransferEnd:   func(stats TransferStats) { ended <- stats },
+	}
+	addr := serve(t, s)
+	c := Client{BlockSize: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.Get(ctx, addr, "file", new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end := <-started, <-ended
+	if start.Filename != "file" || start.Direction != Download || start.Client == nil {
+		t.Errorf("unexpected start stats: %+v", start)
+	}
+	if end.Err != nil || end.Bytes != int64(len(payload)) || end.Blocks != 3 || end.Options[OptBlockSize] != "1024" {
+		t.Errorf("unexpected end stats: %+v", end)
+	}
+	if end.Duration <= 0 || end.RTT <= 0 {
+		t.Errorf("expected duration and rtt: %+v", end)
+	}
+
+	_, _ = c.Get(ctx, addr, "missing", new(bytes.Buffer))
+	<-started
+	if end = <-ended; !errors.Is(end.Err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error; actual %v", end.Err)
+	}
+
+	_, err = c.Put(ctx, addr, "upload", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start = <-started; start.Direction != Upload {
+		t.Errorf("expected an upload; actual %v", start.Direction)
+	}
+	if end = <-ended; end.Err != nil || end.Bytes != int64(len(payload)) || end.Blocks != 3 {
+		t.Errorf("unexpected end stats: %+v", end)
+	}
+}
+
+// BenchmarkDownload reports the allocations of client and server together
+// for every block of a download
+func BenchmarkDownload(b *testing.B) {
+	payload := make([]byte, 1000*BlockSize)
+	addr := serve(b, &Server{Payload: payload})
+	var c Client
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Get(context.Background(), addr, "payload", io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N*(len(payload)/BlockSize+1)), "allocs/block")
+}
+
+func TestPathTraversal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "tftp")
+	if err := os.MkdirAll(filepath.Join(dir, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "x"), []byte("outside"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, &Server{FS: os.DirFS(dir), UploadDir: dir})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+
+	for _, name := range []string{"../etc/passwd", "/etc/passwd", "a/../../x", "../x", "..\\x", "dir"} {
+		for _, op := range []OpCode{OpRRQ, OpWRQ} {
+			var err error
+			if op == OpRRQ {
+				_, err = c.Get(ctx, addr, name, io.Discard)
+			} else {
+				_, err = c.Put(ctx, addr, name, strings.NewReader("payload"))
+			}
+			var remote *RemoteError
+			if !errors.As(err, &remote) || remote.Code != ErrAccessViolation {
+				t.Errorf("%v %s: expected ErrAccessViolation; actual %v", op, name, err)
+			}
+		}
+	}
+	// nothing was written outside of UploadDir
+	if b, err := os.ReadFile(filepath.Join(root, "x")); err != nil || string(b) != "outside" {
+		t.Errorf("file outside of UploadDir changed: %q %v", b, err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries outside of UploadDir; actual %d", len(entries))
+	}
+}
+
+// listen serves s on a loopback socket until the test ends and returns its address
+func listen(t *testing.T, s *Server) net.Addr {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() { _ = s.Serve(conn) }()
+	return conn.LocalAddr()
+}
+
+// rawClient exchanges packets with a server by hand
+type rawClient struct {
+	t    *testing.T
+	conn net.PacketConn
+	buf  []byte
+}
+
+func newRawClient(t *testing.T) *rawClient {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &rawClient{t: t, conn: conn, buf: make([]byte, 65536)}
+}
+
+// send writes pkt to addr
+func (c *rawClient) send(pkt []byte, addr net.Addr) {
+	c.t.Helper()
+	if _, err := c.conn.WriteTo(pkt, addr); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive returns the next packet and the address it came from
+func (c *rawClient) receive() ([]byte, net.Addr) {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := c.conn.ReadFrom(c.buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.buf[:n], addr
+}
+
+// expectAck fails the test unless pkt acknowledges block
+func (c *rawClient) expectAck(pkt []byte, block uint16) {
+	c.t.Helper()
+	var ack Ack
+	if err := ack.UnmarshalBinary(pkt); err != nil || uint16(ack) != block {
+		var errPkt ErrReq
+		_ = errPkt.UnmarshalBinary(pkt)
+		c.t.Fatalf("expected ACK %d; actual %v %q", block, err, errPkt.Message)
+	}
+}
+
+// expectError fails the test unless pkt is an error packet with code
+func (c *rawClient) expectError(pkt []byte, code ErrCode) {
+	c.t.Helper()
+	var errPkt ErrReq
+	if err := errPkt.UnmarshalBinary(pkt); err != nil || errPkt.Error != code {
+		c.t.Fatalf("expected error %d; actual %v %v", code, errPkt, err)
+	}
+}
+
+// abort ends the transfer with the server at tid
+func (c *rawClient) abort(tid net.Addr) {
+	c.t.Helper()
+	errPkt, err := ErrReq{Error: ErrUnknown, Message: "done"}.MarshalBinary()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(errPkt, tid)
+}
+
+// dataPacket returns a DATA packet carrying payload as block
+func dataPacket(block uint16, payload []byte) []byte {
+	pkt := binary.BigEndian.AppendUint16(nil, uint16(OpData))
+	pkt = binary.BigEndian.AppendUint16(pkt, block)
+	return append(pkt, payload...)
+}
+
+func TestUpload(t *testing.T) {
+	dir := t.TempDir()
+	addr := listen(t, &Server{Payload: []byte{}, UploadDir: dir})
+	payload := bytes.Repeat([]byte("firmware"), 100)
+
+	c := newRawClient(t)
+	wrq, err := WriteReq{Filename: "firmware.bin", Mode: "octet"}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(wrq, addr)
+	pkt, tid := c.receive()
+	c.expectAck(pkt, 0)
+	// the block shorter than BlockSize ends the upload
+	for block, off := uint16(1), 0; off < len(payload); block, off = block+1, off+BlockSize {
+		c.send(dataPacket(block, payload[off:min(off+BlockSize, len(payload))]), tid)
+		pkt, _ = c.receive()
+		c.expectAck(pkt, block)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "firmware.bin")); err != nil || !bytes.Equal(b, payload) {
+		t.Errorf("stored %d bytes; expected %d: %v", len(b), len(payload), err)
+	}
+
+	// existing files are never overwritten, names leaving UploadDir are refused
+	tests := []struct {
+		name string
+		code ErrCode
+	}{
+		{"firmware.bin", ErrFileExists},
+		{"../firmware.bin", ErrAccessViolation},
+		{"/tmp/firmware.bin", ErrAccessViolation},
+		{"..\\firmware.bin", ErrAccessViolation},
+		{"missing/firmware.bin", ErrNotFound},
+	}
+	for _, test := range tests {
+		wrq, err := WriteReq{Filename: test.name, Mode: "octet"}.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(wrq, addr)
+		pkt, _ := c.receive()
+		c.expectError(pkt, test.code)
+	}
+}
+
+func TestServeFS(t *testing.T) {
+	loader := bytes.Repeat([]byte{0xAA}, 2*BlockSize+100)
+	addr := listen(t, &Server{FS: fstest.MapFS{"boot/pxelinux.0": {Data: loader}}})
+
+	c := newRawClient(t)
+	rrq, err := ReadReq{Filename: "boot/pxelinux.0", Mode: "octet"}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(rrq, addr)
+	var received []byte
+	for block := uint16(1); ; block++ {
+		pkt, tid := c.receive()
+		var data Data
+		if err := data.UnmarshalBinary(pkt); err != nil || data.Block != block {
+			t.Fatalf("expected block %d; actual %v", block, err)
+		}
+		p, _ := io.ReadAll(data.Payload)
+		received = append(received, p...)
+		ack, _ := Ack(block).MarshalBinary()
+		c.send(ack, tid)
+		if len(p) < BlockSize {
+			break
+		}
+	}
+	if !bytes.Equal(received, loader) {
+		t.Errorf("received %d bytes; expected %d", len(received), len(loader))
+	}
+
+	// missing files are not found, names leaving the FS and directories are refused
+	tests := []struct {
+		name string
+		code ErrCode
+	}{
+		{"boot/missing", ErrNotFound},
+		{"../etc/passwd", ErrAccessViolation},
+		{"/etc/passwd", ErrAccessViolation},
+		{"boot/../../x", ErrAccessViolation},
+		{"boot", ErrAccessViolation},
+	}
+	for _, test := range tests {
+		rrq, err := ReadReq{Filename: test.name, Mode: "octet"}.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(rrq, addr)
+		pkt, _ := c.receive()
+		c.expectError(pkt, test.code)
+	}
+}
@@ -0,0 +1,131 @@
+package tftp
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTransferCanceled ends the transfers canceled with Server.Cancel
+var ErrTransferCanceled = errors.New("tftp: transfer canceled")
+
+// Session describes a transfer in flight
+type Session struct {
+	ID        uint64    `json:"id"`
+	Client    string    `json:"client"`
+	Filename  string    `json:"filename"`
+	Direction string    `json:"direction"`
+	Start     time.Time `json:"start"`
+	Size      int64     `json:"size"`   // size of the file, -1 when unknown
+	Bytes     int64     `json:"bytes"`  // payload bytes acknowledged
+	Blocks    int64     `json:"blocks"` // data blocks acknowledged
+	Rate      float64   `json:"rate"`   // bytes per second since the start
+}
+
+// session is the entry of a transfer in the registry of the server.
+// The transfer updates its progress while the admin API reads it
+type session struct {
+	id     uint64
+	stats  *TransferStats // only the fields set by begin are read
+	cancel context.CancelCauseFunc
+	size   atomic.Int64
+	bytes  atomic.Int64
+	blocks atomic.Int64
+}
+
+// progress records a data block of n payload bytes
+func (ss *session) progress(n int) {
+	ss.blocks.Add(1)
+	ss.bytes.Add(int64(n))
+}
+
+// register adds the transfer of stats to the registry, cancel aborts it
+func (s *Server) register(stats *TransferStats, cancel context.CancelCauseFunc) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*session)
+	}
+	s.lastID++
+	ss := &session{id: s.lastID, stats: stats, cancel: cancel}
+	ss.size.Store(-1)
+	s.sessions[ss.id] = ss
+	return ss
+}
+
+func (s *Server) unregister(ss *session) {
+	s.mu.Lock()
+	delete(s.sessions, ss.id)
+	s.mu.Unlock()
+}
+
+// Sessions returns the transfers in flight ordered by their IDs
+func (s *Server) Sessions() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		info := Session{
+			ID:        ss.id,
+			Client:    ss.stats.Client.String(),
+			Filename:  ss.stats.Filename,
+			Direction: ss.stats.Direction.String(),
+			Start:     ss.stats.Start,
+			Size:      ss.size.Load(),
+			Bytes:     ss.bytes.Load(),
+			Blocks:    ss.blocks.Load(),
+		}
+		if elapsed := time.Since(info.Start).Seconds(); elapsed > 0 {
+			info.Rate = float64(info.Bytes) / elapsed
+		}
+		sessions = append(sessions, info)
+	}
+	slices.SortFunc(sessions, func(a, b Session) int { return cmp.Compare(a.ID, b.ID) })
+	return sessions
+}
+
+// Cancel aborts the transfer with id, the client is sent an error packet.
+// It reports whether the transfer was in flight
+func (s *Server) Cancel(id uint64) bool {
+	s.mu.Lock()
+	ss := s.sessions[id]
+	s.mu.Unlock()
+	if ss == nil {
+		return false
+	}
+	ss.cancel(ErrTransferCanceled)
+	return true
+}
+
+// AdminHandler returns an HTTP handler listing and canceling transfers:
+//
+//	GET    /transfers       the transfers in flight as JSON
+//	DELETE /transfers/{id}  cancels a transfer
+//
+// Anyone reaching it can stop transfers, serve it on a trusted address or unix socket
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /transfers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Sessions())
+	})
+	mux.HandleFunc("DELETE /transfers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid transfer id", http.StatusBadRequest)
+			return
+		}
+		if !s.Cancel(id) {
+			http.Error(w, "no such transfer", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
@@ -0,0 +1,90 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ended := make(chan TransferStats, 1)
+	payload := bytes.Repeat([]byte{'x'}, 3*BlockSize)
+	s := &Server{Payload: payload, OnTransferEnd: func(stats TransferStats) { ended <- stats }}
+	client, _, _ := startTransfer(t, s)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []Session
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 transfer; actual %d", len(sessions))
+	}
+	session := sessions[0]
+	if session.Filename != "payload" || session.Direction != "download" || session.Size != int64(len(payload)) {
+		t.Errorf("unexpected transfer %+v", session)
+	}
+
+	cancel := func(id string) int {
+		req, err := http.NewRequest(http.MethodDelete, admin.URL+"/transfers/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := cancel(strconv.FormatUint(session.ID, 10)); status != http.StatusNoContent {
+		t.Fatalf("expected status %d; actual %d", http.StatusNoContent, status)
+	}
+	// the client learns why the transfer stopped
+	var errPkt ErrReq
+	buf := make([]byte, DatagramSize)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errPkt.UnmarshalBinary(buf[:n]) == nil {
+			break
+		}
+	}
+	if errPkt.Message != "transfer canceled" {
+		t.Errorf("unexpected error message %q", errPkt.Message)
+	}
+	if stats := <-ended; !errors.Is(stats.Err, ErrTransferCanceled) {
+		t.Errorf("expected the transfer to end with %v; actual %v", ErrTransferCanceled, stats.Err)
+	}
+	if sessions := s.Sessions(); len(sessions) != 0 {
+		t.Errorf("expected no transfers; actual %+v", sessions)
+	}
+
+	if status := cancel(strconv.FormatUint(session.ID, 10)); status != http.StatusNotFound {
+		t.Errorf("expected status %d canceling twice; actual %d", http.StatusNotFound, status)
+	}
+	if status := cancel("x"); status != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid id; actual %d", http.StatusBadRequest, status)
+	}
+}
@@ -0,0 +1,55 @@
+package tftp
+
+import (
+	"net"
+	"time"
+)
+
+// Direction tells which way the file of a transfer travels
+type Direction uint8
+
+const (
+	Download Direction = iota // the client reads a file
+	Upload                    // the client writes a file
+)
+
+func (d Direction) String() string {
+	if d == Upload {
+		return "upload"
+	}
+	return "download"
+}
+
+// TransferStats describes a transfer to the OnTransferStart and OnTransferEnd hooks
+type TransferStats struct {
+	Client          net.Addr
+	Filename        string
+	Direction       Direction
+	Options         map[string]string // options the server acknowledged, nil until negotiated
+	Bytes           int64             // payload bytes acknowledged, as sent on the wire
+	Blocks          int               // data blocks acknowledged
+	Retransmissions int               // packets sent again after waiting for the client timed out
+	RTT             time.Duration     // smoothed round-trip time, zero until measured
+	Start           time.Time
+	Duration        time.Duration // set when the transfer ended
+	Err             error         // why the transfer failed, nil on success
+	Checksum        string        // SHA-512/256 of a stored upload in hex, as printed by the sum command
+}
+
+// begin reports a new transfer to OnTransferStart.
+// The returned stats are updated as the transfer goes on
+func (s *Server) begin(addr net.Addr, filename string, dir Direction) *TransferStats {
+	stats := &TransferStats{Client: addr, Filename: filename, Direction: dir, Start: time.Now()}
+	if s.OnTransferStart != nil {
+		s.OnTransferStart(*stats)
+	}
+	return stats
+}
+
+// end reports the outcome of a transfer to OnTransferEnd
+func (s *Server) end(stats *TransferStats) {
+	stats.Duration = time.Since(stats.Start)
+	if s.OnTransferEnd != nil {
+		s.OnTransferEnd(*stats)
+	}
+}
@@ -0,0 +1,191 @@
+package tftp
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// tarFS is a read-only file system over the regular files and directories
+// of an uncompressed tar archive. Members are read straight out of the
+// archive, so they implement io.ReaderAt and io.Seeker
+type tarFS struct {
+	r       io.ReaderAt
+	entries map[string]*tarEntry // by path, "." is the root
+}
+
+type tarEntry struct {
+	info     fs.FileInfo
+	offset   int64    // start of the contents of a file in the archive
+	children []string // names of the entries of a directory, sorted
+}
+
+// newTarFS indexes the size bytes of the tar archive r. Links, devices and
+// other special members are left out
+func newTarFS(r io.ReaderAt, size int64) (*tarFS, error) {
+	t := &tarFS{r: r, entries: make(map[string]*tarEntry)}
+	t.entries["."] = &tarEntry{info: tarDirInfo{name: "."}}
+	cr := &countingSeeker{r: io.NewSectionReader(r, 0, size)}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			// the reader stops right after the header so we are at the contents
+			t.add(name, &tarEntry{info: hdr.FileInfo(), offset: cr.pos})
+		case tar.TypeDir:
+			if e := t.entries[name]; e != nil && e.info.IsDir() {
+				// a directory created for an earlier member takes the real header
+				e.info = hdr.FileInfo()
+				continue
+			}
+			t.add(name, &tarEntry{info: hdr.FileInfo()})
+		}
+	}
+	for _, e := range t.entries {
+		slices.Sort(e.children)
+	}
+	return t, nil
+}
+
+// add adds e as name creating the missing parent directories.
+// A later member replaces an earlier one with the same name
+func (t *tarFS) add(name string, e *tarEntry) {
+	if old := t.entries[name]; old != nil {
+		if old.info.IsDir() || e.info.IsDir() {
+			// a file and a directory of the same name, keep the first one
+			return
+		}
+		t.entries[name] = e
+		return
+	}
+	dir := path.Dir(name)
+	if t.entries[dir] == nil {
+		t.add(dir, &tarEntry{info: tarDirInfo{name: path.Base(dir)}})
+	}
+	// the parent is missing when a file took its name
+	parent := t.entries[dir]
+	if parent == nil || !parent.info.IsDir() {
+		return
+	}
+	t.entries[name] = e
+	parent.children = append(parent.children, path.Base(name))
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	e, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.info.IsDir() {
+		return &tarDir{fsys: t, name: name, entry: e}, nil
+	}
+	return &tarFile{SectionReader: io.NewSectionReader(t.r, e.offset, e.info.Size()), info: e.info}, nil
+}
+
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := t.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (t *tarFS) lookup(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e := t.entries[name]
+	if e == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+// tarFile is an open member of a tar archive
+type tarFile struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Close() error               { return nil }
+
+// tarDir is an open directory of a tar archive
+type tarDir struct {
+	fsys  *tarFS
+	name  string
+	entry *tarEntry
+	read  int // entries returned by ReadDir
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.entry.info, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entry.children[d.read:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(rest) > n {
+		rest = rest[:n]
+	}
+	d.read += len(rest)
+	entries := make([]fs.DirEntry, len(rest))
+	for i, child := range rest {
+		entries[i] = fs.FileInfoToDirEntry(d.fsys.entries[path.Join(d.name, child)].info)
+	}
+	return entries, nil
+}
+
+// tarDirInfo describes a directory without a header of its own
+type tarDirInfo struct {
+	name string
+}
+
+func (i tarDirInfo) Name() string       { return i.name }
+func (i tarDirInfo) Size() int64        { return 0 }
+func (i tarDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (i tarDirInfo) ModTime() time.Time { return time.Time{} }
+func (i tarDirInfo) IsDir() bool        { return true }
+func (i tarDirInfo) Sys() any           { return nil }
+
+// countingSeeker tracks the position in the archive while the tar reader
+// reads headers and seeks over the contents of members
+type countingSeeker struct {
+	r   io.ReadSeeker
+	pos int64
+}
+
+func (c *countingSeeker) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *countingSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := c.r.Seek(offset, whence)
+	if err == nil {
+		c.pos = pos
+	}
+	return pos, err
+}
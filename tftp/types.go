@@ -2,25 +2,31 @@ package tftp
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
 	"strings"
 )
 
 const (
 	DatagramSize = 516              // manimum supported datagram size
 	BlockSize    = DatagramSize - 4 // header size
+	MinBlockSize = 8                // smallest blksize a client may negotiate (RFC 2348)
+	MaxBlockSize = 65464            // largest blksize a client may negotiate (RFC 2348)
 )
 
 type OpCode uint16
 
 const (
-	OpRRQ OpCode = iota + 1 // Read Request Code
-	_
-	OpData // Data code
-	OpAck  // Acknolegment code
-	OpErr  // Err code
+	OpRRQ  OpCode = iota + 1 // Read Request Code
+	OpWRQ                    // Write Request Code
+	OpData                   // Data code
+	OpAck                    // Acknolegment code
+	OpErr                    // Err code
+	OpOAck                   // Option Acknowledgment code
 )
 
 type ErrCode uint16
@@ -34,11 +40,131 @@ const (
 	ErrUnknownId
 	ErrFileExists
 	ErrNoUser
+	ErrOptNegotiation // the options were refused (RFC 2347)
 )
 
+func (op OpCode) String() string {
+	switch op {
+	case OpRRQ:
+		return "RRQ"
+	case OpWRQ:
+		return "WRQ"
+	case OpData:
+		return "DATA"
+	case OpAck:
+		return "ACK"
+	case OpErr:
+		return "ERROR"
+	case OpOAck:
+		return "OACK"
+	}
+	return fmt.Sprintf("OpCode(%d)", uint16(op))
+}
+
+// Reasons a packet is malformed, the decoders return them wrapped in a
+// *PacketError so errors.Is tells them apart
+var (
+	ErrShortPacket      = errors.New("tftp: packet too short")
+	ErrLongPacket       = errors.New("tftp: packet too long")
+	ErrUnknownOpCode    = errors.New("tftp: unknown op code")
+	ErrUnexpectedOpCode = errors.New("tftp: unexpected op code") // the packet has another type
+	ErrUnterminated     = errors.New("tftp: string not null terminated")
+	ErrEmptyFilename    = errors.New("tftp: empty filename")
+	ErrUnsupportedMode  = errors.New("tftp: unsupported transfer mode")
+	ErrInvalidOption    = errors.New("tftp: invalid option") // an empty or repeated option name
+)
+
+// PacketError reports a packet that could not be decoded
+type PacketError struct {
+	Op  OpCode // type of packet being decoded, zero when the op code is missing
+	Err error  // one of the reasons above
+}
+
+func (e *PacketError) Error() string {
+	reason := strings.TrimPrefix(e.Err.Error(), "tftp: ")
+	if e.Op == 0 {
+		return "tftp: malformed packet: " + reason
+	}
+	return fmt.Sprintf("tftp: malformed %s: %s", e.Op, reason)
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+// Packet is a decoded packet, one of *ReadReq, *WriteReq, *Data, *Ack,
+// *ErrReq and *OAck
+type Packet interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// Parse decodes p according to its op code.
+// The payload of a *Data shares the memory of p
+func Parse(p []byte) (Packet, error) {
+	if len(p) < 2 {
+		return nil, &PacketError{Err: ErrShortPacket}
+	}
+	var pkt Packet
+	switch op := OpCode(binary.BigEndian.Uint16(p)); op {
+	case OpRRQ:
+		pkt = new(ReadReq)
+	case OpWRQ:
+		pkt = new(WriteReq)
+	case OpData:
+		pkt = new(Data)
+	case OpAck:
+		pkt = new(Ack)
+	case OpErr:
+		pkt = new(ErrReq)
+	case OpOAck:
+		pkt = new(OAck)
+	default:
+		return nil, &PacketError{Op: op, Err: ErrUnknownOpCode}
+	}
+	if err := pkt.UnmarshalBinary(p); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// checkPacket checks that p is a packet of type op at least min bytes long.
+// It returns the reason unwrapped, the hot paths test packets against
+// several types and must not allocate on a mismatch
+func checkPacket(op OpCode, p []byte, min int) error {
+	if len(p) < 2 {
+		return ErrShortPacket
+	}
+	if OpCode(binary.BigEndian.Uint16(p)) != op {
+		return ErrUnexpectedOpCode
+	}
+	if len(p) < min {
+		return ErrShortPacket
+	}
+	return nil
+}
+
+// readString returns the null terminated string p starts with and the bytes following it
+func readString(p []byte) (string, []byte, error) {
+	i := bytes.IndexByte(p, 0)
+	if i < 0 {
+		return "", nil, ErrUnterminated
+	}
+	return string(p[:i]), p[i+1:], nil
+}
+
 type ReadReq struct {
 	Filename string
 	Mode     string
+	Options  map[string]string // RFC 2347 options, names are lower case
+}
+
+// WriteReq shares the layout of ReadReq
+// the client uploads Filename to the server
+type WriteReq struct {
+	Filename string
+	Mode     string
+	Options  map[string]string // RFC 2347 options, names are lower case
 }
 
 type Data struct {
@@ -48,6 +174,9 @@ type Data struct {
 
 type Ack uint16 // representing the block number
 
+// OAck acknowledges the options the server accepted (RFC 2347)
+type OAck map[string]string
+
 // Error packet
 type ErrReq struct {
 	Error   ErrCode
@@ -55,24 +184,47 @@ type ErrReq struct {
 }
 
 // Creates the request packet structure
-// 2 bytes - opCode | n bytes - filename | 1 byte - 0 | n byte - mode | 1 byte - 0
-//
-//	WARNING:   I don't we shoud add 4 bytes for OpCode
+// 2 bytes - opCode | n bytes - filename | 1 byte - 0 | n byte - mode | 1 byte - 0 | options
 func (q ReadReq) MarshalBinary() ([]byte, error) {
-	mode := "octet"
-	if q.Mode != "" {
-		mode = q.Mode
+	return marshalRequest(OpRRQ, q.Filename, q.Mode, q.Options)
+}
+
+// Reads the request packet structure
+// 2 bytes - opCode | n bytes - filename | 1 byte - 0 | n byte - mode | 1 byte - 0 | options
+func (q *ReadReq) UnmarshalBinary(p []byte) error {
+	var err error
+	q.Filename, q.Mode, q.Options, err = unmarshalRequest(OpRRQ, p)
+	return err
+}
+
+// Creates the write request packet structure
+// 2 bytes - opCode | n bytes - filename | 1 byte - 0 | n byte - mode | 1 byte - 0 | options
+func (q WriteReq) MarshalBinary() ([]byte, error) {
+	return marshalRequest(OpWRQ, q.Filename, q.Mode, q.Options)
+}
+
+// Reads the write request packet structure
+// 2 bytes - opCode | n bytes - filename | 1 byte - 0 | n byte - mode | 1 byte - 0 | options
+func (q *WriteReq) UnmarshalBinary(p []byte) error {
+	var err error
+	q.Filename, q.Mode, q.Options, err = unmarshalRequest(OpWRQ, p)
+	return err
+}
+
+// marshalRequest writes the layout shared by read and write requests
+func marshalRequest(op OpCode, filename, mode string, options map[string]string) ([]byte, error) {
+	if mode == "" {
+		mode = ModeOctet
 	}
-	// Here ----------
-	cap := 2 + 2 + len(q.Filename) + 1 + len(q.Mode) + 1
+	cap := 2 + len(filename) + 1 + len(mode) + 1 + optionsLen(options)
 	b := new(bytes.Buffer)
 	b.Grow(cap)
 
-	err := binary.Write(b, binary.BigEndian, OpRRQ)
+	err := binary.Write(b, binary.BigEndian, op)
 	if err != nil {
 		return nil, err
 	}
-	_, err = b.WriteString(q.Filename)
+	_, err = b.WriteString(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -88,164 +240,229 @@ func (q ReadReq) MarshalBinary() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	writeOptions(b, options)
 	return b.Bytes(), nil
 }
 
-// Reads the request packet structure
-// 2 bytes - opCode | n bytes - filename | 1 byte - 0 | n byte - mode | 1 byte - 0
-func (q *ReadReq) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
-	var code OpCode
-	err := binary.Read(r, binary.BigEndian, &code)
+// unmarshalRequest reads the filename, mode and options of a read or write request
+func unmarshalRequest(op OpCode, p []byte) (filename, mode string, options map[string]string, err error) {
+	filename, mode, options, err = parseRequest(op, p)
 	if err != nil {
-		return err
+		return "", "", nil, &PacketError{Op: op, Err: err}
 	}
-	if code != OpRRQ {
-		return errors.New("invalid RRQ")
+	return filename, mode, options, nil
+}
+
+// parseRequest is unmarshalRequest returning the reason a request is malformed
+func parseRequest(op OpCode, p []byte) (filename, mode string, options map[string]string, err error) {
+	// the shortest request has a one byte filename and mode
+	if err = checkPacket(op, p, 2+2+2); err != nil {
+		return "", "", nil, err
 	}
-	q.Filename, err = r.ReadString(0)
+	filename, rest, err := readString(p[2:])
 	if err != nil {
-		return errors.New("invalid RRQ")
+		return "", "", nil, err
 	}
-	q.Filename = strings.TrimRight(q.Filename, "\x00")
-	if len(q.Filename) == 0 {
-		return errors.New("invalid RRQ")
+	if len(filename) == 0 {
+		return "", "", nil, ErrEmptyFilename
 	}
-	q.Mode, err = r.ReadString(0)
+	mode, rest, err = readString(rest)
 	if err != nil {
-		return errors.New("invalid RRQ")
+		return "", "", nil, err
 	}
-	q.Mode = strings.TrimRight(q.Mode, "\x00")
-	if len(q.Filename) == 0 {
-		return errors.New("invalid RRQ")
+	actual := strings.ToLower(mode)
+	if actual != ModeOctet && actual != ModeNetASCII {
+		return "", "", nil, ErrUnsupportedMode
 	}
-	actual := strings.ToLower(q.Mode)
-	if actual != "octet" {
-		return errors.New("only binary transfers supported")
+	options, err = readOptions(rest)
+	if err != nil {
+		return "", "", nil, err
 	}
-	return nil
+	return filename, mode, options, nil
 }
 
-// creates the data packet structur
-// 2 bytes - opCode | 2 bytes - block number | n byte - payload
-func (d *Data) MarshalBinary() ([]byte, error) {
-	b := new(bytes.Buffer)
-	b.Grow(DatagramSize)
-	d.Block++
+// optionsLen returns the encoded size of the options
+func optionsLen(options map[string]string) int {
+	n := 0
+	for name, value := range options {
+		n += len(name) + 1 + len(value) + 1
+	}
+	return n
+}
 
-	err := binary.Write(b, binary.BigEndian, OpData)
-	if err != nil {
-		return nil, err
+// writeOptions appends the options as null terminated name and value pairs.
+// Names are sorted so the encoding is deterministic
+func writeOptions(b *bytes.Buffer, options map[string]string) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
 	}
-	err = binary.Write(b, binary.BigEndian, d.Block)
-	if err != nil {
-		return nil, err
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(options[name])
+		b.WriteByte(0)
+	}
+}
+
+// readOptions reads null terminated name and value pairs until p is drained.
+// Option names are case insensitive so they are returned in lower case
+func readOptions(p []byte) (map[string]string, error) {
+	if len(p) == 0 {
+		return nil, nil
 	}
-	_, err = io.CopyN(b, d.Payload, BlockSize)
-	if err != nil && err != io.EOF {
+	options := make(map[string]string)
+	for len(p) > 0 {
+		name, rest, err := readString(p)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := readString(rest)
+		if err != nil {
+			return nil, err
+		}
+		name = strings.ToLower(name)
+		if _, ok := options[name]; ok || len(name) == 0 {
+			return nil, ErrInvalidOption
+		}
+		options[name] = value
+		p = rest
+	}
+	return options, nil
+}
+
+// creates the data packet structur
+// 2 bytes - opCode | 2 bytes - block number | n byte - payload
+// The packet carries Block and up to BlockSize bytes read from Payload
+func (d *Data) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4, DatagramSize)
+	n, err := io.ReadFull(d.Payload, b[4:DatagramSize])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return nil, err
 	}
-	return b.Bytes(), nil
+	return AppendData(b[:0], d.Block, b[4:4+n]), nil
 }
 
 // reads the data packet structur
 // 2 bytes - opCode | 2 bytes - block number | n byte - payload
 func (d *Data) UnmarshalBinary(p []byte) error {
-	if l := len(p); l < 4 || l > DatagramSize {
-		return errors.New("Invalid OpData")
+	block, payload, err := parseData(p)
+	if err != nil {
+		return &PacketError{Op: OpData, Err: err}
 	}
+	d.Block = block
+	d.Payload = bytes.NewBuffer(payload)
+	return nil
+}
 
-	var code OpCode
-	err := binary.Read(bytes.NewReader(p[:2]), binary.BigEndian, &code)
-	if err != nil {
-		return errors.New("Invalid OpData")
+// parseData returns the block number and the payload of a data packet,
+// the payload shares the memory of p
+func parseData(p []byte) (block uint16, payload []byte, err error) {
+	if err = checkPacket(OpData, p, 4); err != nil {
+		return 0, nil, err
 	}
-	err = binary.Read(bytes.NewReader(p[2:4]), binary.BigEndian, &d.Block)
-	if err != nil {
-		return errors.New("Invalid OpData")
+	if len(p) > 4+MaxBlockSize {
+		return 0, nil, ErrLongPacket
 	}
-	d.Payload = bytes.NewBuffer(p[4:])
-	return nil
+	return binary.BigEndian.Uint16(p[2:]), p[4:], nil
+}
+
+// AppendData appends a data packet carrying payload as block to dst.
+// It allocates only when dst lacks the capacity, so a transfer can encode
+// every block into the same buffer
+// 2 bytes - opCode | 2 bytes - block number | n byte - payload
+func AppendData(dst []byte, block uint16, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(OpData))
+	dst = binary.BigEndian.AppendUint16(dst, block)
+	return append(dst, payload...)
+}
+
+// AppendAck appends the acknowledgment of block to dst
+// 2 bytes - OpCode | 2 bytes - block number
+func AppendAck(dst []byte, block uint16) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(OpAck))
+	return binary.BigEndian.AppendUint16(dst, block)
+}
+
+// AppendError appends an error packet to dst
+// 2 bytes - OpCode | 2 bytes - Err Code | n bytes - Message string | 1 byte - null
+func AppendError(dst []byte, code ErrCode, msg string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(OpErr))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(code))
+	dst = append(dst, msg...)
+	return append(dst, 0)
 }
 
 // writes the achnowledgment packet
 // 2 bytes - OpCode | 2 bytes - block number
 func (a Ack) MarshalBinary() ([]byte, error) {
-	cap := 2 + 2 // opcode + block number
-	b := new(bytes.Buffer)
-	b.Grow(cap)
-
-	err := binary.Write(b, binary.BigEndian, OpAck)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Write(b, binary.BigEndian, a)
-	if err != nil {
-		return nil, err
-	}
-	return b.Bytes(), nil
+	return AppendAck(make([]byte, 0, 4), uint16(a)), nil
 }
 
 // reads the achnowledgment packet
 // 2 bytes - OpCode | 2 bytes - block number
 func (a *Ack) UnmarshalBinary(p []byte) error {
-	r := bytes.NewReader(p)
-	var code OpCode
-	err := binary.Read(r, binary.BigEndian, &code)
-	if err != nil {
-		return nil
+	if err := checkPacket(OpAck, p, 4); err != nil {
+		return &PacketError{Op: OpAck, Err: err}
 	}
-	if code != OpAck {
-		return errors.New("Invalid ack")
+	if len(p) > 4 {
+		return &PacketError{Op: OpAck, Err: ErrLongPacket}
 	}
-	return binary.Read(r, binary.BigEndian, a)
+	*a = Ack(binary.BigEndian.Uint16(p[2:]))
+	return nil
 }
 
 // writes the Error packet
 // 2 bytes - OpCode | 2 bytes - Err Code | n bytes - Message string | 1 byte - null
 func (e ErrReq) MarshalBinary() ([]byte, error) {
-	cap := 2 + 2 + len(e.Message) + 1 // buffer size
-	b := new(bytes.Buffer)            // make the buffer
-	b.Grow(cap)                       // grow the buffer
+	return AppendError(make([]byte, 0, 2+2+len(e.Message)+1), e.Error, e.Message), nil
+}
 
-	err := binary.Write(b, binary.BigEndian, OpErr) // write opError
-	if err != nil {
-		return nil, err
+// reads the Error packet
+// 2 bytes - OpCode | 2 bytes - Err Code | n bytes - Message string | 1 byte - null
+func (e *ErrReq) UnmarshalBinary(p []byte) error {
+	if err := checkPacket(OpErr, p, 2+2+1); err != nil {
+		return &PacketError{Op: OpErr, Err: err}
 	}
-	err = binary.Write(b, binary.BigEndian, e.Error) // write error code
+	msg, rest, err := readString(p[4:])
 	if err != nil {
-		return nil, err
+		return &PacketError{Op: OpErr, Err: err}
 	}
-	_, err = b.WriteString(e.Message) // write the error message to the buffer
-	if err != nil {
-		return nil, err
+	if len(rest) > 0 {
+		return &PacketError{Op: OpErr, Err: ErrLongPacket}
 	}
-	err = b.WriteByte(0) // write one byte "0"/null to the buffer
+	e.Error = ErrCode(binary.BigEndian.Uint16(p[2:]))
+	e.Message = msg
+	return nil
+}
+
+// writes the option acknowledgment packet
+// 2 bytes - OpCode | n bytes - option name | 1 byte - 0 | n bytes - value | 1 byte - 0 | ...
+func (o OAck) MarshalBinary() ([]byte, error) {
+	b := new(bytes.Buffer)
+	b.Grow(2 + optionsLen(o))
+
+	err := binary.Write(b, binary.BigEndian, OpOAck)
 	if err != nil {
 		return nil, err
 	}
+	writeOptions(b, o)
 	return b.Bytes(), nil
 }
 
-func (e *ErrReq) UnmarshalBinary(p []byte) error {
-	r := bytes.NewBuffer(p)
-	var code OpCode
-	err := binary.Read(r, binary.BigEndian, &code)
-	if err != nil {
-		return err
-	}
-	if code != OpErr {
-		return errors.New("invalid error")
-	}
-	err = binary.Read(r, binary.BigEndian, &e.Error)
-	if err != nil {
-		return err
+// reads the option acknowledgment packet, it acknowledges at least one option
+// 2 bytes - OpCode | n bytes - option name | 1 byte - 0 | n bytes - value | 1 byte - 0 | ...
+func (o *OAck) UnmarshalBinary(p []byte) error {
+	// the opcode and the shortest option, a one byte name with an empty value
+	if err := checkPacket(OpOAck, p, 5); err != nil {
+		return &PacketError{Op: OpOAck, Err: err}
 	}
-	e.Message, err = r.ReadString(0)
+	options, err := readOptions(p[2:])
 	if err != nil {
-		return nil
+		return &PacketError{Op: OpOAck, Err: err}
 	}
-	e.Message = strings.TrimRight(e.Message, "\x00")
+	*o = options
 	return nil
 }
 
@@ -0,0 +1,205 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRequestOptions(t *testing.T) {
+	rrq := ReadReq{
+		Filename: "pxelinux.0",
+		Mode:     "octet",
+		Options:  map[string]string{"blksize": "1428", "tsize": "0"},
+	}
+	b, err := rrq.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual ReadReq
+	err = actual.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rrq, actual) {
+		t.Errorf("value mismatch: %v != %v", rrq, actual)
+	}
+
+	// option names are case insensitive
+	b = append(b[:len(b)-len("tsize\x000\x00")], "TSize\x000\x00"...)
+	err = actual.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := actual.Options["tsize"]; !ok || v != "0" {
+		t.Errorf("expected tsize option; actual: %v", actual.Options)
+	}
+
+	// a name without a value is malformed
+	err = actual.UnmarshalBinary(b[:len(b)-2])
+	if err == nil {
+		t.Error("expected an error for a truncated option")
+	}
+}
+
+func TestOAck(t *testing.T) {
+	oack := OAck{"blksize": "1428"}
+	b, err := oack.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual OAck
+	err = actual.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(oack, actual) {
+		t.Errorf("value mismatch: %v != %v", oack, actual)
+	}
+	var ack Ack
+	if ack.UnmarshalBinary(b) == nil {
+		t.Error("OACK unmarshaled as ACK")
+	}
+}
+
+func TestAppendPackets(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, BlockSize)
+	buf := make([]byte, 0, DatagramSize)
+	pkt := AppendData(buf, 7, payload)
+	var data Data
+	if err := data.UnmarshalBinary(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(data.Payload); data.Block != 7 || !bytes.Equal(b, payload) {
+		t.Errorf("decoded block %d with %d bytes", data.Block, len(b))
+	}
+	var ack Ack
+	if err := ack.UnmarshalBinary(AppendAck(buf[:0], 9)); err != nil || ack != 9 {
+		t.Errorf("decoded ack %d: %v", ack, err)
+	}
+	var errPkt ErrReq
+	if err := errPkt.UnmarshalBinary(AppendError(buf[:0], ErrDiskFull, "full")); err != nil || errPkt.Error != ErrDiskFull || errPkt.Message != "full" {
+		t.Errorf("decoded error %+v: %v", errPkt, err)
+	}
+
+	// encoding into a buffer with room to spare never allocates
+	allocs := testing.AllocsPerRun(100, func() {
+		pkt = AppendData(buf[:0], 7, payload)
+		pkt = AppendAck(pkt[:0], 7)
+		pkt = AppendError(pkt[:0], ErrUnknown, "unknown")
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations; actual %v", allocs)
+	}
+
+	// marshaling leaves the block number alone
+	data = Data{Block: 3, Payload: bytes.NewReader(payload)}
+	pkt, err := data.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Block != 3 || !bytes.Equal(pkt, AppendData(nil, 3, payload)) {
+		t.Errorf("marshaled block %d into %d bytes", data.Block, len(pkt))
+	}
+}
+
+func BenchmarkAppendData(b *testing.B) {
+	payload := make([]byte, BlockSize)
+	buf := make([]byte, 0, DatagramSize)
+	b.ReportAllocs()
+	b.SetBytes(BlockSize)
+	for i := 0; i < b.N; i++ {
+		buf = AppendData(buf[:0], uint16(i), payload)
+	}
+}
+
+func BenchmarkDataMarshalBinary(b *testing.B) {
+	payload := make([]byte, BlockSize)
+	r := bytes.NewReader(payload)
+	b.ReportAllocs()
+	b.SetBytes(BlockSize)
+	for i := 0; i < b.N; i++ {
+		r.Reset(payload)
+		d := Data{Block: uint16(i), Payload: r}
+		if _, err := d.MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	valid := []struct {
+		name string
+		pkt  []byte
+		want Packet
+	}{
+		{"rrq", []byte("\x00\x01file\x00octet\x00"), &ReadReq{Filename: "file", Mode: "octet"}},
+		{"wrq", []byte("\x00\x02file\x00NetASCII\x00blksize\x001024\x00"), &WriteReq{Filename: "file", Mode: "NetASCII", Options: map[string]string{"blksize": "1024"}}},
+		{"ack", []byte{0, 4, 1, 2}, ptr(Ack(0x102))},
+		{"error", []byte("\x00\x05\x00\x01no such file\x00"), &ErrReq{Error: ErrNotFound, Message: "no such file"}},
+		{"empty error", []byte("\x00\x05\x00\x00\x00"), &ErrReq{}},
+		{"oack", []byte("\x00\x06tsize\x0042\x00"), &OAck{"tsize": "42"}},
+	}
+	for _, test := range valid {
+		pkt, err := Parse(test.pkt)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(pkt, test.want) {
+			t.Errorf("%s: decoded %#v; expected %#v", test.name, pkt, test.want)
+		}
+	}
+	pkt, err := Parse([]byte{0, 3, 0, 1, 'h', 'i'})
+	if data, ok := pkt.(*Data); err != nil || !ok || data.Block != 1 {
+		t.Fatalf("decoded %#v: %v", pkt, err)
+	}
+
+	malformed := []struct {
+		name string
+		pkt  []byte
+		op   OpCode
+		err  error
+	}{
+		{"empty", nil, 0, ErrShortPacket},
+		{"unknown op code", []byte{0, 42}, 42, ErrUnknownOpCode},
+		{"short request", []byte("\x00\x01f\x00"), OpRRQ, ErrShortPacket},
+		{"empty filename", []byte("\x00\x01\x00octet\x00"), OpRRQ, ErrEmptyFilename},
+		{"missing mode", []byte("\x00\x01file\x00oct"), OpRRQ, ErrUnterminated},
+		{"unsupported mode", []byte("\x00\x02file\x00mail\x00"), OpWRQ, ErrUnsupportedMode},
+		{"option without value", []byte("\x00\x01file\x00octet\x00tsize\x00"), OpRRQ, ErrUnterminated},
+		{"empty option name", []byte("\x00\x01file\x00octet\x00\x000\x00"), OpRRQ, ErrInvalidOption},
+		{"repeated option", []byte("\x00\x01file\x00octet\x00tsize\x000\x00TSIZE\x000\x00"), OpRRQ, ErrInvalidOption},
+		{"short data", []byte{0, 3, 0}, OpData, ErrShortPacket},
+		{"long data", append([]byte{0, 3, 0, 1}, make([]byte, MaxBlockSize+1)...), OpData, ErrLongPacket},
+		{"short ack", []byte{0, 4, 0}, OpAck, ErrShortPacket},
+		{"long ack", []byte{0, 4, 0, 1, 0}, OpAck, ErrLongPacket},
+		{"short error", []byte{0, 5, 0, 1}, OpErr, ErrShortPacket},
+		{"unterminated error", []byte("\x00\x05\x00\x01oops"), OpErr, ErrUnterminated},
+		{"trailing error bytes", []byte("\x00\x05\x00\x01oops\x00x"), OpErr, ErrLongPacket},
+		{"empty oack", []byte{0, 6}, OpOAck, ErrShortPacket},
+		{"truncated oack", []byte("\x00\x06tsize\x0042"), OpOAck, ErrUnterminated},
+	}
+	for _, test := range malformed {
+		_, err := Parse(test.pkt)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v; actual %v", test.name, test.err, err)
+		}
+		var pktErr *PacketError
+		if !errors.As(err, &pktErr) || pktErr.Op != test.op {
+			t.Errorf("%s: expected a %v packet error; actual %v", test.name, test.op, err)
+		}
+	}
+
+	// decoding a packet as another type tells it apart from a malformed one
+	var ack Ack
+	if err := ack.UnmarshalBinary([]byte{0, 3, 0, 1}); !errors.Is(err, ErrUnexpectedOpCode) {
+		t.Errorf("expected %v; actual %v", ErrUnexpectedOpCode, err)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,200 @@
+package tftp
+
+import (
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+)
+
+var errQuotaExceeded = errors.New("tftp: upload quota exceeded")
+
+// upload is a file being received. It is written to a temporary file
+// next to its target and only takes its place once complete, so a failed
+// upload never replaces or leaves behind a partial file
+type upload struct {
+	target string
+	tmp    *os.File
+	sum    hash.Hash // SHA-512/256 of the contents, as the sum command computes it
+	w      io.Writer
+}
+
+// createUpload starts the upload of target. Unless overwrite is set an
+// existing target is refused before any data is accepted
+func createUpload(target string, overwrite bool) (*upload, error) {
+	// a replaced file keeps its permissions, new files get the usual ones
+	mode := fs.FileMode(0o644)
+	if info, err := os.Lstat(target); err == nil {
+		// a directory is no file to upload to, it is never replaced
+		if info.IsDir() {
+			return nil, &fs.PathError{Op: "create", Path: target, Err: fs.ErrInvalid}
+		}
+		if !overwrite {
+			return nil, &fs.PathError{Op: "create", Path: target, Err: fs.ErrExist}
+		}
+		if info.Mode().IsRegular() {
+			mode = info.Mode().Perm()
+		}
+	}
+	tmp, err := createTemp(target, mode)
+	if err != nil {
+		return nil, err
+	}
+	u := &upload{target: target, tmp: tmp, sum: sha512.New512_256()}
+	u.w = io.MultiWriter(tmp, u.sum)
+	return u, nil
+}
+
+// createTemp creates the hidden file next to target that is renamed to it
+// once complete. It gets mode as os.CreateTemp creates files only their
+// owner may read
+func createTemp(target string, mode fs.FileMode) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+func (u *upload) Write(p []byte) (int, error) {
+	return u.w.Write(p)
+}
+
+// commit moves the complete file into place. It returns the size of the
+// file it replaced, zero when there was none
+func (u *upload) commit(overwrite bool) (replaced int64, err error) {
+	if err = u.tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err = u.tmp.Close(); err != nil {
+		return 0, err
+	}
+	if !overwrite {
+		// a link fails when the target appeared in the meantime, a rename would replace it
+		err = os.Link(u.tmp.Name(), u.target)
+		if err == nil {
+			return 0, os.Remove(u.tmp.Name())
+		}
+		if errors.Is(err, fs.ErrExist) {
+			return 0, err
+		}
+		// file systems without hard links
+		return 0, renameNoReplace(u.tmp.Name(), u.target)
+	}
+	if info, err := os.Lstat(u.target); err == nil && info.Mode().IsRegular() {
+		replaced = info.Size()
+	}
+	return replaced, os.Rename(u.tmp.Name(), u.target)
+}
+
+// checkedRename moves oldpath to newpath unless newpath exists. It is the
+// fallback of renameNoReplace, a file created in between is replaced
+func checkedRename(oldpath, newpath string) error {
+	if _, err := os.Lstat(newpath); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// abort removes the temporary file of an incomplete upload
+func (u *upload) abort() {
+	_ = u.tmp.Close()
+	_ = os.Remove(u.tmp.Name())
+}
+
+// checksum returns the digest of the contents in hex
+func (u *upload) checksum() string {
+	return fmt.Sprintf("%x", u.sum.Sum(nil))
+}
+
+// fits reports whether the client at addr may store n more bytes
+func (s *Server) fits(addr net.Addr, n int64) bool {
+	client, _ := clientIP(addr)
+	s.measureUsage()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withinQuota(client, n)
+}
+
+// reserve accounts for n more bytes stored by the client at addr.
+// It reports false, reserving nothing, when a quota would be exceeded
+func (s *Server) reserve(addr net.Addr, n int64) bool {
+	client, _ := clientIP(addr)
+	s.measureUsage()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.withinQuota(client, n) {
+		return false
+	}
+	if s.clientUsage == nil {
+		s.clientUsage = make(map[netip.Addr]int64)
+	}
+	s.usage += n
+	s.clientUsage[client] += n
+	return true
+}
+
+// withinQuota reports whether client may store n more bytes, s.mu must be held
+func (s *Server) withinQuota(client netip.Addr, n int64) bool {
+	if s.UploadQuota > 0 && s.usage+n > s.UploadQuota {
+		return false
+	}
+	return s.ClientQuota <= 0 || s.clientUsage[client]+n <= s.ClientQuota
+}
+
+// measureUsage adds up the files in UploadDir the first time a quota is checked
+func (s *Server) measureUsage() {
+	if s.UploadQuota <= 0 {
+		return
+	}
+	s.usageOnce.Do(func() {
+		usage := dirSize(s.UploadDir)
+		s.mu.Lock()
+		s.usage += usage
+		s.mu.Unlock()
+	})
+}
+
+// unreserve gives back n bytes reserved for the client at addr
+func (s *Server) unreserve(addr net.Addr, n int64) {
+	client, _ := clientIP(addr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage -= n
+	if s.clientUsage[client] -= n; s.clientUsage[client] <= 0 {
+		delete(s.clientUsage, client)
+	}
+}
+
+// freed accounts for n bytes of a replaced file
+func (s *Server) freed(n int64) {
+	s.mu.Lock()
+	s.usage -= n
+	s.mu.Unlock()
+}
+
+// dirSize returns the bytes held by the regular files below dir
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,155 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSafeUploads(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	if err := os.WriteFile(config, []byte("good"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(config, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan TransferStats, 1)
+	addr := serve(t, &Server{
+		Payload:       []byte{},
+		UploadDir:     dir,
+		Overwrite:     true,
+		OnTransferEnd: func(stats TransferStats) { ended <- stats },
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+
+	// an upload failing half way leaves the good file alone
+	data := bytes.Repeat([]byte("new config\n"), 300)
+	r := io.MultiReader(bytes.NewReader(data[:2000]), iotest.ErrReader(errors.New("read failed")))
+	if _, err := c.Put(ctx, addr, "config", r); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if stats := <-ended; stats.Err == nil {
+		t.Fatal("expected the server to fail the upload")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the good file to be left; actual %d files", len(entries))
+	}
+	if b, _ := os.ReadFile(config); string(b) != "good" {
+		t.Errorf("good file replaced by %d bytes", len(b))
+	}
+
+	// a complete upload takes its place
+	if _, err = c.Put(ctx, addr, "config", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	stats := <-ended
+	if b, _ := os.ReadFile(config); !bytes.Equal(b, data) {
+		t.Errorf("stored %d bytes; expected %d", len(b), len(data))
+	}
+	if expected := fmt.Sprintf("%x", sha512.Sum512_256(data)); stats.Checksum != expected {
+		t.Errorf("checksum %s; expected %s", stats.Checksum, expected)
+	}
+
+	// a replaced file keeps its permissions, a new one is readable by everyone
+	mode := func(name string) fs.FileMode {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+	if m := mode("config"); m != 0o640 {
+		t.Errorf("replaced file has mode %v; expected %v", m, fs.FileMode(0o640))
+	}
+	if _, err = c.Put(ctx, addr, "new", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+	if m := mode("new"); m != 0o644 {
+		t.Errorf("new file has mode %v; expected %v", m, fs.FileMode(0o644))
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, name := range []string{src, dst} {
+		if err := os.WriteFile(name, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := renameNoReplace(src, dst); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected %v; actual %v", fs.ErrExist, err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != dst {
+		t.Errorf("existing file replaced by %q", b)
+	}
+	if err := os.Remove(dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameNoReplace(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != src {
+		t.Errorf("moved file holds %q", b)
+	}
+}
+
+func TestUploadQuotas(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "existing"), make([]byte, 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c Client
+	put := func(addr, name string, size int) error {
+		_, err := c.Put(ctx, addr, name, bytes.NewReader(make([]byte, size)))
+		return err
+	}
+	full := func(err error) bool {
+		var remote *RemoteError
+		return errors.As(err, &remote) && remote.Code == ErrDiskFull
+	}
+
+	// the files already in the upload directory count
+	addr := serve(t, &Server{Payload: []byte{}, UploadDir: dir, UploadQuota: 1500})
+	if err := put(addr, "big", 1000); !full(err) {
+		t.Errorf("expected the disk quota to be exceeded; actual %v", err)
+	}
+	if err := put(addr, "small", 400); err != nil {
+		t.Fatal(err)
+	}
+
+	// a refused upload frees what it reserved
+	addr = serve(t, &Server{Payload: []byte{}, UploadDir: dir, ClientQuota: 1000})
+	if err := put(addr, "a", 300); err != nil {
+		t.Fatal(err)
+	}
+	// without a size to check up front the upload fails once a block exceeds the quota
+	_, err := c.Put(ctx, addr, "b", io.MultiReader(bytes.NewReader(make([]byte, 900))))
+	if !full(err) {
+		t.Errorf("expected the client quota to be exceeded; actual %v", err)
+	}
+	if err := put(addr, "c", 700); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"network-golang/tftp"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var (
+	blockSize  = flag.Int("b", 0, "block size to negotiate, zero uses the default")
+	windowSize = flag.Uint("w", 0, "window size to negotiate")
+	mode       = flag.String("m", tftp.ModeOctet, "transfer mode, octet or netascii")
+	retries    = flag.Uint("r", 10, "number of retries on lost packets")
+	timeout    = flag.Duration("t", 6*time.Second, "waiting duration of a reply")
+	rollover   = flag.Uint("rollover", 0, "block number following 65535, 0 or 1")
+)
+
+func init() {
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage:\n\t%s [flags] get|put <host:port> <remote file> [local file]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 3 || flag.NArg() > 4 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// the client fields are narrower than the flags
+	switch {
+	case *windowSize > 65535:
+		usageError("-w must be at most 65535")
+	case *retries > 255:
+		usageError("-r must be at most 255")
+	case *rollover > 1:
+		usageError("-rollover must be 0 or 1")
+	}
+	cmd, addr, remote := flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	// the local file defaults to the base name of the remote one, "-" is stdin or stdout
+	local := path.Base(remote)
+	if flag.NArg() == 4 {
+		local = flag.Arg(3)
+	}
+	c := tftp.Client{
+		BlockSize:  *blockSize,
+		WindowSize: uint16(*windowSize),
+		Mode:       *mode,
+		Retries:    uint8(*retries),
+		Timeout:    *timeout,
+		Rollover:   uint16(*rollover),
+	}
+	// cancel the transfer on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	start := time.Now()
+	var (
+		n   int64
+		err error
+	)
+	switch cmd {
+	case "get":
+		n, err = get(ctx, c, addr, remote, local)
+	case "put":
+		n, err = put(ctx, c, addr, remote, local)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s %s: %d bytes in %v", cmd, remote, n, time.Since(start).Round(time.Millisecond))
+}
+
+// usageError reports a bad flag value the way the flag package does and exits
+func usageError(msg string) {
+	_, _ = fmt.Fprintln(flag.CommandLine.Output(), msg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// get downloads remote into the local file, removing it if the transfer fails
+func get(ctx context.Context, c tftp.Client, addr, remote, local string) (int64, error) {
+	if local == "-" {
+		return c.Get(ctx, addr, remote, os.Stdout)
+	}
+	f, err := os.Create(local)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Get(ctx, addr, remote, f)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(local)
+	}
+	return n, err
+}
+
+// put uploads the local file as remote
+func put(ctx context.Context, c tftp.Client, addr, remote, local string) (int64, error) {
+	var r io.Reader = os.Stdin
+	if local != "-" {
+		f, err := os.Open(local)
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = f.Close() }()
+		r = f
+	}
+	return c.Put(ctx, addr, remote, r)
+}